@@ -0,0 +1,54 @@
+package cgroup
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrUnsupported = errors.New("当前平台不支持 cgroup v2")
+
+// Manager creates one child cgroup per build job below Root and applies the
+// configured CPU and memory limits to it.
+type Manager struct {
+	Root   string
+	CPUs   float64
+	Memory int64
+}
+
+func ParseSize(value string) (int64, error) {
+	value = strings.TrimSpace(strings.ToUpper(value))
+	if value == "" {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(value, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(value, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(value, "G"):
+		multiplier = 1 << 30
+	case strings.HasSuffix(value, "T"):
+		multiplier = 1 << 40
+	}
+	if multiplier > 1 {
+		value = value[:len(value)-1]
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil || parsed < 0 {
+		return 0, fmt.Errorf("无法解析内存大小: %s", value)
+	}
+	return int64(parsed * float64(multiplier)), nil
+}
+
+func FormatSize(bytes int64) string {
+	switch {
+	case bytes >= 1<<30 && bytes%(1<<30) == 0:
+		return fmt.Sprintf("%dG", bytes>>30)
+	case bytes >= 1<<20 && bytes%(1<<20) == 0:
+		return fmt.Sprintf("%dM", bytes>>20)
+	}
+	return strconv.FormatInt(bytes, 10)
+}
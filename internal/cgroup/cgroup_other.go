@@ -0,0 +1,25 @@
+//go:build !linux
+
+package cgroup
+
+import "os/exec"
+
+type Group struct{}
+
+func NewManager(root string, cpus float64, memory int64) (*Manager, error) {
+	return nil, ErrUnsupported
+}
+
+func (m *Manager) Create(name string) (*Group, error) {
+	return nil, ErrUnsupported
+}
+
+func (g *Group) Attach(cmd *exec.Cmd) {}
+
+func (g *Group) OOMKills() int {
+	return 0
+}
+
+func (g *Group) Remove() error {
+	return nil
+}
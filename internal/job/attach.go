@@ -0,0 +1,75 @@
+package job
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrJobShared = errors.New("该任务由多个提交共享，请使用提交时返回的 handle 取消等待")
+
+// Submission is the outcome of submitting a build request. Handle
+// identifies this submission among all those sharing the job; it is empty
+// when a finished artifact was reused.
+type Submission struct {
+	Job    *Job
+	Reused bool
+	Handle string
+}
+
+// attachment is one submission waiting for a job: whoever sent it and where
+// to notify them.
+type attachment struct {
+	Handle      string   `json:"handle"`
+	Requester   string   `json:"requester"`
+	NotifyEmail string   `json:"notifyEmail,omitempty"`
+	Webhooks    []string `json:"webhooks,omitempty"`
+}
+
+// submissions returns the submissions attached to the job; jobs stored before
+// submissions were tracked count their own request as the only one.
+func (j *Job) submissions() []attachment {
+	if len(j.attachments) == 0 {
+		return []attachment{{Requester: j.Requester, NotifyEmail: j.Request.NotifyEmail, Webhooks: j.Request.Webhooks}}
+	}
+	return j.attachments
+}
+
+// NotifyEmails returns the addresses emailed when the job succeeds or fails.
+func (j *Job) NotifyEmails() []string {
+	var emails []string
+	for _, attached := range j.submissions() {
+		if attached.NotifyEmail != "" {
+			emails = mergeUnique(emails, []string{attached.NotifyEmail})
+		}
+	}
+	return emails
+}
+
+// Webhooks returns the per-request webhooks notified when the job finishes.
+func (j *Job) Webhooks() []string {
+	var targets []string
+	for _, attached := range j.submissions() {
+		targets = mergeUnique(targets, attached.Webhooks)
+	}
+	return targets
+}
+
+// detachLocked removes the submission identified by handle from a shared
+// job, which keeps running for the others.
+func (q *Queue) detachLocked(job *Job, handle string) error {
+	attached := job.submissions()
+	remaining := make([]attachment, 0, len(attached))
+	for _, candidate := range attached {
+		if handle == "" || candidate.Handle != handle {
+			remaining = append(remaining, candidate)
+		}
+	}
+	if len(remaining) == len(attached) {
+		return ErrJobShared
+	}
+	job.attachments = remaining
+	line := q.appendLogLocked(job, StreamSystem, fmt.Sprintf("一个提交已取消等待，任务继续为其余 %d 个提交编译", len(remaining)))
+	q.events.Publish(Event{Type: EventLogLine, JobID: job.ID, Log: &line})
+	q.persistLocked()
+	return nil
+}
@@ -0,0 +1,69 @@
+package job
+
+import (
+	"sort"
+	"time"
+)
+
+const defaultBuildEstimate = 15 * time.Minute
+
+func (q *Queue) typicalDuration() time.Duration {
+	if q.history == nil {
+		return defaultBuildEstimate
+	}
+	durations := q.history.RecentDurations(20)
+	if len(durations) == 0 {
+		return defaultBuildEstimate
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	return durations[len(durations)/2]
+}
+
+// slotsLocked returns, for every worker, how long until it is expected to be free.
+func (q *Queue) slotsLocked(typical time.Duration, now time.Time) []time.Duration {
+	slots := make([]time.Duration, 0, q.workers)
+	for _, job := range q.jobs {
+		if job.Status != StatusRunning || job.StartedAt == nil {
+			continue
+		}
+		remaining := typical - now.Sub(*job.StartedAt)
+		if remaining < 0 {
+			remaining = 0
+		}
+		slots = append(slots, remaining)
+	}
+	for len(slots) < q.workers || len(slots) == 0 {
+		slots = append(slots, 0)
+	}
+	sort.Slice(slots, func(i, j int) bool { return slots[i] < slots[j] })
+	return slots
+}
+
+func (q *Queue) refreshEstimatesLocked() {
+	typical := q.typicalDuration()
+	now := time.Now()
+	slots := q.slotsLocked(typical, now)
+	for i, job := range q.pending.ordered() {
+		next := 0
+		for k := range slots {
+			if slots[k] < slots[next] {
+				next = k
+			}
+		}
+		start := now.Add(slots[next])
+		job.Position = i + 1
+		job.EstimatedStart = &start
+		slots[next] += typical
+	}
+}
+
+func (q *Queue) RetryAfter() time.Duration {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	slots := q.slotsLocked(q.typicalDuration(), time.Now())
+	wait := slots[0]
+	if wait < time.Minute {
+		wait = time.Minute
+	}
+	return wait
+}
@@ -0,0 +1,180 @@
+package job
+
+import (
+	"sync"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventJobQueued      EventType = "job.queued"
+	EventJobStarted     EventType = "job.started"
+	EventStepChanged    EventType = "job.step"
+	EventLogLine        EventType = "job.log"
+	EventJobSucceeded   EventType = "job.succeeded"
+	EventJobFailed      EventType = "job.failed"
+	EventJobCancelled   EventType = "job.cancelled"
+	EventJobInterrupted EventType = "job.interrupted"
+)
+
+// Terminal reports whether the event closes a job's lifecycle.
+func (t EventType) Terminal() bool {
+	switch t {
+	case EventJobSucceeded, EventJobFailed, EventJobCancelled, EventJobInterrupted:
+		return true
+	}
+	return false
+}
+
+// Event describes one job state change. Job is a snapshot taken when the
+// event was published and is set for every type except EventLogLine; Step
+// and Log carry the changed step or the new line.
+type Event struct {
+	Type  EventType `json:"type"`
+	JobID string    `json:"jobId"`
+	Time  time.Time `json:"time"`
+	Job   *Job      `json:"job,omitempty"`
+	Step  *Step     `json:"step,omitempty"`
+	Log   *LogLine  `json:"log,omitempty"`
+}
+
+// Bus fans job events out to subscribers. Each subscriber has its own
+// goroutine and unbounded backlog, so a slow consumer never blocks the queue
+// and never loses events.
+type Bus struct {
+	mu     sync.Mutex
+	subs   map[int]*subscriber
+	nextID int
+	closed bool
+	wg     sync.WaitGroup
+}
+
+type subscriber struct {
+	match  func(Event) bool
+	handle func(Event)
+	mu     sync.Mutex
+	events []Event
+	done   bool
+	wake   chan struct{}
+}
+
+func NewBus() *Bus {
+	return &Bus{subs: make(map[int]*subscriber)}
+}
+
+// Subscribe calls handle for every published event accepted by match (all
+// events when match is nil). The returned function unsubscribes; events
+// already queued for the subscriber are still delivered.
+func (b *Bus) Subscribe(match func(Event) bool, handle func(Event)) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return func() {}
+	}
+	sub := &subscriber{match: match, handle: handle, wake: make(chan struct{}, 1)}
+	id := b.nextID
+	b.nextID++
+	b.subs[id] = sub
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		sub.run()
+	}()
+	return func() {
+		b.mu.Lock()
+		delete(b.subs, id)
+		b.mu.Unlock()
+		sub.stop()
+	}
+}
+
+func (b *Bus) Publish(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, sub := range b.subs {
+		if sub.match == nil || sub.match(event) {
+			sub.push(event)
+		}
+	}
+}
+
+// Close stops accepting subscribers and waits until every subscriber has
+// handled its backlog.
+func (b *Bus) Close() {
+	b.mu.Lock()
+	b.closed = true
+	subs := b.subs
+	b.subs = make(map[int]*subscriber)
+	b.mu.Unlock()
+	for _, sub := range subs {
+		sub.stop()
+	}
+	b.wg.Wait()
+}
+
+func (s *subscriber) push(event Event) {
+	s.mu.Lock()
+	s.events = append(s.events, event)
+	s.mu.Unlock()
+	s.signal()
+}
+
+func (s *subscriber) stop() {
+	s.mu.Lock()
+	s.done = true
+	s.mu.Unlock()
+	s.signal()
+}
+
+func (s *subscriber) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscriber) run() {
+	for range s.wake {
+		s.mu.Lock()
+		events := s.events
+		s.events = nil
+		done := s.done
+		s.mu.Unlock()
+		for _, event := range events {
+			s.handle(event)
+		}
+		if done {
+			return
+		}
+	}
+}
+
+// snapshot copies the parts of a job that subscribers may read after the
+// queue lock is released; only the most recent log lines are kept.
+func (j *Job) snapshot() *Job {
+	copied := *j
+	copied.cancel = nil
+	copied.cgroup = nil
+	copied.logFile = nil
+	copied.Steps = append([]Step{}, j.Steps...)
+	if len(j.Logs) > snapshotLogLines {
+		copied.Logs = append([]LogLine{}, j.Logs[len(j.Logs)-snapshotLogLines:]...)
+	} else {
+		copied.Logs = append([]LogLine{}, j.Logs...)
+	}
+	return &copied
+}
+
+const snapshotLogLines = 50
+
+func (q *Queue) Events() *Bus {
+	return q.events
+}
+
+func (q *Queue) publishLocked(eventType EventType, job *Job) {
+	q.events.Publish(Event{Type: eventType, JobID: job.ID, Job: job.snapshot()})
+}
@@ -0,0 +1,70 @@
+package job
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"nginx-automake/internal/sandbox"
+)
+
+// Executor carries out the commands of a build plan.
+type Executor interface {
+	Run(ctx context.Context, jobID string, cmd Command) error
+}
+
+// localExecutor runs commands on this host in the job's process group and
+// cgroup, wrapping the sandboxed ones in namespaces.
+type localExecutor struct {
+	q *Queue
+}
+
+func (e localExecutor) Run(ctx context.Context, jobID string, command Command) error {
+	if command.Builtin {
+		switch command.Name {
+		case "cp":
+			if err := os.MkdirAll(filepath.Dir(command.Args[1]), 0o755); err != nil {
+				return err
+			}
+			return copyFile(command.Args[0], command.Args[1])
+		default:
+			return fmt.Errorf("未知的内置命令 %s", command.Name)
+		}
+	}
+	cmd := exec.CommandContext(ctx, command.Name, command.Args...)
+	cmd.Dir = command.Dir
+	cmd.Env = commandEnv(filepath.Join(e.q.workRoot, jobID), command)
+	setProcessGroup(cmd)
+	if command.sandbox != nil {
+		defer os.RemoveAll(command.sandbox.Root)
+		if err := sandbox.Wrap(cmd, *command.sandbox); err != nil {
+			return fmt.Errorf("启动沙箱失败: %w", err)
+		}
+	}
+	return e.q.execute(jobID, cmd)
+}
+
+// inheritedEnv lists the only server variables build commands see, so tokens
+// and passwords in the server's environment never reach configure scripts,
+// make or hooks.
+var inheritedEnv = []string{"PATH", "LANG", "TMPDIR"}
+
+// commandEnv is the environment of a build command: the allow-listed server
+// variables, HOME pointing at the job's work directory and the command's own
+// variables.
+func commandEnv(workDir string, command Command) []string {
+	env := []string{"HOME=" + workDir}
+	for _, name := range inheritedEnv {
+		if value, ok := os.LookupEnv(name); ok {
+			// The sandbox mounts its own /tmp; the server's TMPDIR may not
+			// exist inside it.
+			if name == "TMPDIR" && command.sandbox != nil {
+				value = "/tmp"
+			}
+			env = append(env, name+"="+value)
+		}
+	}
+	return append(env, command.Env...)
+}
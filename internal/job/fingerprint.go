@@ -0,0 +1,113 @@
+package job
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+
+	"nginx-automake/internal/parser"
+)
+
+type fingerprintModule struct {
+	Name string `json:"name"`
+	Repo string `json:"repo"`
+	Flag string `json:"flag"`
+	Ref  string `json:"ref"`
+}
+
+// Fingerprint returns a canonical hash of everything that influences the
+// produced binary: normalized configure arguments, version, module set and
+// hook profile. Arguments keep their order, since configure applies repeated
+// options such as --with-cc-opt in sequence.
+func (q *Queue) Fingerprint(req BuildRequest) string {
+	var args []string
+	if parsed, err := parser.ParseNginxV(req.Output); err == nil {
+		args = q.composeConfigureArgs(parsed.Arguments, nil)
+	}
+
+	var mods []fingerprintModule
+	for _, name := range req.ModuleNames {
+		entry := fingerprintModule{Name: name}
+		if mod, ok := q.registry.Get(name); ok {
+			entry.Repo, entry.Flag, entry.Ref = mod.Repo, mod.Flag, mod.Ref
+		}
+		mods = append(mods, entry)
+	}
+	for _, custom := range req.CustomModules {
+		flag := custom.Flag
+		if flag == "" {
+			flag = "add-module"
+		}
+		mods = append(mods, fingerprintModule{
+			Name: "custom:" + strings.TrimSpace(custom.Name),
+			Repo: strings.TrimSpace(custom.Repo),
+			Flag: flag,
+			Ref:  strings.TrimSpace(custom.Ref),
+		})
+	}
+	sort.Slice(mods, func(i, j int) bool { return mods[i].Name < mods[j].Name })
+
+	data, _ := json.Marshal(struct {
+		Version     string              `json:"version"`
+		Arguments   []string            `json:"arguments"`
+		Modules     []fingerprintModule `json:"modules"`
+		HookProfile string              `json:"hookProfile,omitempty"`
+	}{requestVersion(req), args, mods, req.HookProfile})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// pinned reports whether every module of req is fixed to a ref, so that an
+// earlier artifact still matches what a new build would check out.
+func (q *Queue) pinned(req BuildRequest) bool {
+	for _, name := range req.ModuleNames {
+		if mod, ok := q.registry.Get(name); !ok || mod.Ref == "" {
+			return false
+		}
+	}
+	for _, custom := range req.CustomModules {
+		if strings.TrimSpace(custom.Ref) == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// findReusableLocked returns a queued or running job with the fingerprint,
+// or, when finished is true, a successful one whose artifact still exists.
+func (q *Queue) findReusableLocked(fingerprint string, finished bool) *Job {
+	var reusable *Job
+	for _, job := range q.jobs {
+		if job.Fingerprint != fingerprint {
+			continue
+		}
+		switch job.Status {
+		case StatusQueued, StatusRunning:
+			return job
+		case StatusSuccess:
+			if !finished || job.ArtifactPath == "" {
+				continue
+			}
+			if _, err := os.Stat(job.ArtifactPath); err != nil {
+				continue
+			}
+			if reusable == nil || job.CreatedAt.After(reusable.CreatedAt) {
+				reusable = job
+			}
+		}
+	}
+	if finished && reusable == nil && q.history != nil {
+		for _, entry := range q.history.List() {
+			if entry.Fingerprint != fingerprint || entry.Status != string(StatusSuccess) || entry.Artifact == "" {
+				continue
+			}
+			if _, err := os.Stat(entry.Artifact); err == nil {
+				return jobFromHistory(entry)
+			}
+		}
+	}
+	return reusable
+}
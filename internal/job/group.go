@@ -0,0 +1,272 @@
+package job
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"nginx-automake/internal/parser"
+)
+
+// maxMatrixVersions bounds how many child jobs one request may fan out to.
+const maxMatrixVersions = 10
+
+// maxGroups is how many of the newest groups are kept.
+const maxGroups = 200
+
+type GroupStatus string
+
+const (
+	GroupQueued  GroupStatus = "queued"
+	GroupRunning GroupStatus = "running"
+	GroupSuccess GroupStatus = "success"
+	GroupPartial GroupStatus = "partial"
+	GroupFailed  GroupStatus = "failed"
+	GroupExpired GroupStatus = "expired"
+)
+
+// StatusExpired marks a group member whose job is gone from both memory and
+// history, so its outcome is no longer known.
+const StatusExpired Status = "expired"
+
+type GroupMember struct {
+	Version string `json:"version"`
+	JobID   string `json:"jobId"`
+	Reused  bool   `json:"reused,omitempty"`
+	// Handle cancels this member on behalf of the group; see Queue.Cancel.
+	Handle string `json:"handle,omitempty"`
+}
+
+// Group ties together the per-version jobs of one matrix request. A member
+// may be a job that was already queued or finished and got reused.
+type Group struct {
+	ID        string        `json:"id"`
+	CreatedAt time.Time     `json:"createdAt"`
+	Requester string        `json:"requester"`
+	Members   []GroupMember `json:"members"`
+}
+
+// GroupJob is a member job's summary plus its place in the matrix.
+type GroupJob struct {
+	JobSummary
+	Version     string `json:"version"`
+	Reused      bool   `json:"reused,omitempty"`
+	ArtifactURL string `json:"artifactUrl,omitempty"`
+}
+
+type GroupView struct {
+	ID        string      `json:"id"`
+	CreatedAt time.Time   `json:"createdAt"`
+	Requester string      `json:"requester"`
+	Status    GroupStatus `json:"status"`
+	Jobs      []GroupJob  `json:"jobs"`
+}
+
+// matrixVersions returns the deduplicated target versions of a matrix
+// request, or nil for a single-version request.
+func matrixVersions(req BuildRequest) ([]string, error) {
+	if len(req.TargetVersions) == 0 {
+		return nil, nil
+	}
+	if strings.TrimSpace(req.TargetVersion) != "" {
+		return nil, errors.New("targetVersion 与 targetVersions 不能同时指定")
+	}
+	var versions []string
+	seen := map[string]bool{}
+	for _, version := range req.TargetVersions {
+		version = strings.TrimSpace(version)
+		if !parser.ValidVersion(version) {
+			return nil, fmt.Errorf("目标版本号格式不正确: %s", version)
+		}
+		if !seen[version] {
+			seen[version] = true
+			versions = append(versions, version)
+		}
+	}
+	if len(versions) > maxMatrixVersions {
+		return nil, fmt.Errorf("一次最多编译 %d 个版本", maxMatrixVersions)
+	}
+	return versions, nil
+}
+
+// SubmitMatrix submits one job per target version of req and groups them.
+// Either every child is accepted or none is: children queued before a
+// failure are cancelled again, and children coalesced onto other jobs are
+// detached from them.
+func (q *Queue) SubmitMatrix(req BuildRequest, requester string) (*Group, error) {
+	versions, err := matrixVersions(req)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, errors.New("targetVersions 不能为空")
+	}
+	groupID, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	group := &Group{ID: groupID, CreatedAt: time.Now(), Requester: requester}
+	for _, version := range versions {
+		child := req
+		child.TargetVersion = version
+		child.TargetVersions = nil
+		submission, err := q.Submit(child, requester)
+		if err != nil {
+			for _, member := range group.Members {
+				// Only reused finished artifacts come without a handle, and
+				// there is nothing to undo for them.
+				if member.Handle != "" {
+					_, _ = q.Cancel(member.JobID, member.Handle)
+				}
+			}
+			return nil, err
+		}
+		group.Members = append(group.Members, GroupMember{Version: version, JobID: submission.Job.ID, Reused: submission.Reused, Handle: submission.Handle})
+	}
+
+	q.mu.Lock()
+	q.groups[group.ID] = group
+	q.persistGroupsLocked()
+	q.mu.Unlock()
+	return group, nil
+}
+
+func (q *Queue) Group(id string) (GroupView, bool) {
+	q.mu.RLock()
+	group, ok := q.groups[id]
+	q.mu.RUnlock()
+	if !ok {
+		return GroupView{}, false
+	}
+	view := GroupView{ID: group.ID, CreatedAt: group.CreatedAt, Requester: group.Requester, Jobs: []GroupJob{}}
+	counts := map[Status]int{}
+	for _, member := range group.Members {
+		entry := GroupJob{Version: member.Version, Reused: member.Reused}
+		if job, found := q.Get(member.JobID); found {
+			q.mu.RLock()
+			entry.JobSummary = summarize(job)
+			q.mu.RUnlock()
+		} else {
+			entry.JobSummary = JobSummary{ID: member.JobID, Status: StatusExpired, Version: member.Version, Error: "任务记录已过期清理，结果未知"}
+		}
+		if entry.Status == StatusSuccess && entry.HasArtifact {
+			entry.ArtifactURL = "/api/jobs/" + member.JobID + "/download"
+		}
+		counts[entry.Status]++
+		view.Jobs = append(view.Jobs, entry)
+	}
+	view.Status = groupStatus(counts, len(group.Members))
+	return view, true
+}
+
+func groupStatus(counts map[Status]int, total int) GroupStatus {
+	switch {
+	case counts[StatusExpired] == total:
+		return GroupExpired
+	case counts[StatusQueued] == total:
+		return GroupQueued
+	case counts[StatusQueued]+counts[StatusRunning] > 0:
+		return GroupRunning
+	case counts[StatusSuccess] == total:
+		return GroupSuccess
+	case counts[StatusSuccess] > 0:
+		return GroupPartial
+	default:
+		return GroupFailed
+	}
+}
+
+func (q *Queue) restoreGroups() error {
+	if q.groupStore == nil {
+		return nil
+	}
+	list, err := q.groupStore.Load()
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, group := range list {
+		q.groups[group.ID] = group
+	}
+	return nil
+}
+
+// persistGroupsLocked saves the newest maxGroups groups and forgets older
+// ones.
+func (q *Queue) persistGroupsLocked() {
+	list := make([]*Group, 0, len(q.groups))
+	for _, group := range q.groups {
+		list = append(list, group)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.After(list[j].CreatedAt)
+	})
+	if len(list) > maxGroups {
+		for _, group := range list[maxGroups:] {
+			delete(q.groups, group.ID)
+		}
+		list = list[:maxGroups]
+	}
+	if q.groupStore != nil {
+		_ = q.groupStore.Save(list)
+	}
+}
+
+type GroupStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewGroupStore(path string) *GroupStore {
+	return &GroupStore{path: path}
+}
+
+func (s *GroupStore) Load() ([]*Group, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var list []*Group
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (s *GroupStore) Save(list []*Group) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
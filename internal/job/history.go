@@ -9,13 +9,29 @@ import (
 )
 
 type HistoryEntry struct {
-	ID        string    `json:"id"`
-	CreatedAt time.Time `json:"createdAt"`
-	Version   string    `json:"version"`
-	Modules   []string  `json:"modules"`
-	Status    string    `json:"status"`
-	Artifact  string    `json:"artifact"`
-	Error     string    `json:"error"`
+	ID          string        `json:"id"`
+	CreatedAt   time.Time     `json:"createdAt"`
+	StartedAt   *time.Time    `json:"startedAt,omitempty"`
+	FinishedAt  *time.Time    `json:"finishedAt,omitempty"`
+	Version     string        `json:"version"`
+	Modules     []string      `json:"modules"`
+	Status      string        `json:"status"`
+	Artifact    string        `json:"artifact"`
+	Error       string        `json:"error"`
+	Request     *BuildRequest `json:"request,omitempty"`
+	Steps       []Step        `json:"steps,omitempty"`
+	Fingerprint string        `json:"fingerprint,omitempty"`
+	LogFile     string        `json:"logFile,omitempty"`
+	TimedOut    bool          `json:"timedOut,omitempty"`
+}
+
+// Public returns the entry with its request redacted.
+func (e HistoryEntry) Public() HistoryEntry {
+	if e.Request != nil {
+		req := e.Request.Redacted()
+		e.Request = &req
+	}
+	return e
 }
 
 type HistoryStore struct {
@@ -59,9 +75,44 @@ func (h *HistoryStore) List() []HistoryEntry {
 	return result
 }
 
+func (h *HistoryStore) Get(id string) (HistoryEntry, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, entry := range h.list {
+		if entry.ID == id {
+			return entry, true
+		}
+	}
+	return HistoryEntry{}, false
+}
+
+func (h *HistoryStore) RecentDurations(limit int) []time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var durations []time.Duration
+	for _, entry := range h.list {
+		if len(durations) >= limit {
+			break
+		}
+		if entry.Status != string(StatusSuccess) || entry.StartedAt == nil || entry.FinishedAt == nil {
+			continue
+		}
+		durations = append(durations, entry.FinishedAt.Sub(*entry.StartedAt))
+	}
+	return durations
+}
+
+// Append records entry as the newest one. An earlier entry of the same job,
+// e.g. from an interruption before the job was re-queued, is replaced.
 func (h *HistoryStore) Append(entry HistoryEntry) error {
 	h.mu.Lock()
 	defer h.mu.Unlock()
+	for i := range h.list {
+		if h.list[i].ID == entry.ID {
+			h.list = append(h.list[:i:i], h.list[i+1:]...)
+			break
+		}
+	}
 	h.list = append([]HistoryEntry{entry}, h.list...)
 	if len(h.list) > 200 {
 		h.list = h.list[:200]
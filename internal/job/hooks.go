@@ -0,0 +1,124 @@
+package job
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+type HookPoint string
+
+const (
+	HookAfterExtract  HookPoint = "after-extract"
+	HookAfterModules  HookPoint = "after-modules"
+	HookAfterMake     HookPoint = "after-make"
+	HookAfterArtifact HookPoint = "after-artifact"
+)
+
+// hookPoints maps every hook point to the built-in step it follows.
+var hookPoints = []struct {
+	Point HookPoint
+	After string
+}{
+	{HookAfterExtract, "准备源代码"},
+	{HookAfterModules, "准备模块"},
+	{HookAfterMake, "执行编译"},
+	{HookAfterArtifact, "整理产物"},
+}
+
+var validHookProfile = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Hook is an executable resolved from the hooks directory when the job is
+// submitted, so the step list stays stable while the job waits in the queue.
+type Hook struct {
+	Point HookPoint `json:"point"`
+	// Name is the path relative to the hooks directory and doubles as the
+	// step name suffix.
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+func (h Hook) StepName() string {
+	return "钩子 " + h.Name
+}
+
+// HookEnv is exported to hook scripts as AUTOMAKE_* variables. Fields that
+// are not known yet at a hook point stay empty.
+type HookEnv struct {
+	JobID         string
+	WorkDir       string
+	SrcDir        string
+	Version       string
+	ConfigureArgs []string
+	Binary        string
+	Artifact      string
+}
+
+// resolveHooks lists the server-wide hooks followed by the hooks of profile.
+// Hooks live in <HooksDir>/<point>/ and <HooksDir>/profiles/<profile>/<point>/
+// and run in file name order; non-executable files are ignored.
+func (q *Queue) resolveHooks(profile string) ([]Hook, error) {
+	if profile != "" && !validHookProfile.MatchString(profile) {
+		return nil, errors.New("钩子配置名称仅支持字母、数字、- 和 _")
+	}
+	if q.hooksDir == "" {
+		if profile != "" {
+			return nil, errors.New("服务器未配置构建钩子")
+		}
+		return nil, nil
+	}
+	roots := []string{"."}
+	if profile != "" {
+		root := filepath.Join("profiles", profile)
+		if info, err := os.Stat(filepath.Join(q.hooksDir, root)); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("钩子配置 %s 不存在", profile)
+		}
+		roots = append(roots, root)
+	}
+	var hooks []Hook
+	for _, point := range hookPoints {
+		for _, root := range roots {
+			dir := filepath.Join(root, string(point.Point))
+			entries, err := os.ReadDir(filepath.Join(q.hooksDir, dir))
+			if err != nil {
+				continue
+			}
+			sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+			for _, entry := range entries {
+				info, err := entry.Info()
+				if err != nil || !info.Mode().IsRegular() || info.Mode()&0o111 == 0 {
+					continue
+				}
+				name := filepath.ToSlash(filepath.Join(dir, entry.Name()))
+				hooks = append(hooks, Hook{
+					Point: point.Point,
+					Name:  name,
+					Path:  filepath.Join(q.hooksDir, dir, entry.Name()),
+				})
+			}
+		}
+	}
+	return hooks, nil
+}
+
+// stepsFor inserts one step per hook after the built-in step it follows.
+func stepsFor(hooks []Hook) []Step {
+	var steps []Step
+	for _, step := range defaultSteps() {
+		steps = append(steps, step)
+		for _, point := range hookPoints {
+			if point.After != step.Name {
+				continue
+			}
+			for _, hook := range hooks {
+				if hook.Point == point.Point {
+					steps = append(steps, Step{Name: hook.StepName(), Status: StepPending})
+				}
+			}
+		}
+	}
+	return steps
+}
@@ -0,0 +1,73 @@
+package job
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// AcceptLease adds a job leased from a coordinator to this queue so it can
+// be run with RunLease and observed with Watch and Snapshot. Hooks are
+// resolved against this host's hooks directory.
+func (q *Queue) AcceptLease(lease Lease) (*Job, error) {
+	hooks, err := q.resolveHooks(lease.Request.HookProfile)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	job := &Job{
+		ID:        lease.JobID,
+		CreatedAt: now,
+		Status:    StatusRunning,
+		Steps:     stepsFor(hooks),
+		Logs:      []LogLine{},
+		Request:   lease.Request,
+		Hooks:     hooks,
+		StartedAt: &now,
+	}
+	q.mu.Lock()
+	q.jobs[job.ID] = job
+	q.mu.Unlock()
+	return job, nil
+}
+
+// RunLease builds an accepted job within the lease's timeout. The job stays
+// in the queue until ReleaseLease so its result can still be read.
+func (q *Queue) RunLease(ctx context.Context, lease Lease) error {
+	q.mu.RLock()
+	job, ok := q.jobs[lease.JobID]
+	q.mu.RUnlock()
+	if !ok {
+		return ErrJobNotFound
+	}
+	timeout := time.Duration(lease.Timeout)
+	q.mu.Lock()
+	job.timeout = timeout
+	q.mu.Unlock()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	err := q.runJob(ctx, job)
+	q.mu.Lock()
+	if err == nil {
+		job.Status = StatusSuccess
+	} else {
+		job.Status = StatusFailed
+		job.Error = err.Error()
+	}
+	finishedAt := time.Now()
+	job.FinishedAt = &finishedAt
+	q.mu.Unlock()
+	return err
+}
+
+// ReleaseLease forgets a leased job and removes its work directory.
+func (q *Queue) ReleaseLease(jobID string) {
+	q.mu.Lock()
+	delete(q.jobs, jobID)
+	q.mu.Unlock()
+	_ = os.RemoveAll(filepath.Join(q.workRoot, jobID))
+}
@@ -0,0 +1,54 @@
+package job
+
+import (
+	"context"
+	"errors"
+)
+
+var ErrDraining = errors.New("服务处于排空模式，暂不接受新的编译任务")
+
+func (q *Queue) SetDraining(enabled bool) {
+	q.mu.Lock()
+	q.draining = enabled
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+func (q *Queue) Draining() bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.draining
+}
+
+// Shutdown stops dispatching, waits for running jobs until ctx expires and
+// then interrupts whatever is still running. Queued jobs stay persisted.
+// Event subscribers are flushed before it returns.
+func (q *Queue) Shutdown(ctx context.Context) {
+	defer q.events.Close()
+	q.mu.Lock()
+	q.draining = true
+	q.stopped = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+
+	done := make(chan struct{})
+	go func() {
+		q.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+	}
+
+	q.mu.Lock()
+	for _, job := range q.jobs {
+		if job.Status == StatusRunning && job.cancel != nil {
+			job.abortStatus = StatusInterrupted
+			job.cancel()
+		}
+	}
+	q.mu.Unlock()
+	<-done
+}
@@ -0,0 +1,149 @@
+package job
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"nginx-automake/internal/parser"
+)
+
+type JobSummary struct {
+	ID          string    `json:"id"`
+	CreatedAt   time.Time `json:"createdAt"`
+	Status      Status    `json:"status"`
+	Version     string    `json:"version"`
+	Modules     []string  `json:"modules"`
+	Priority    Priority  `json:"priority"`
+	Requester   string    `json:"requester"`
+	Error       string    `json:"error"`
+	HasArtifact bool      `json:"hasArtifact"`
+
+	Position       int        `json:"position,omitempty"`
+	EstimatedStart *time.Time `json:"estimatedStart,omitempty"`
+}
+
+type ListFilter struct {
+	Statuses []Status
+	Version  string
+	Module   string
+	Since    time.Time
+	Until    time.Time
+	Page     int
+	PageSize int
+}
+
+type JobList struct {
+	Items    []JobSummary `json:"items"`
+	Total    int          `json:"total"`
+	Page     int          `json:"page"`
+	PageSize int          `json:"pageSize"`
+}
+
+func (q *Queue) List(filter ListFilter) JobList {
+	q.mu.Lock()
+	q.refreshEstimatesLocked()
+	matched := make([]JobSummary, 0)
+	for _, job := range q.jobs {
+		summary := summarize(job)
+		if filter.match(summary) {
+			matched = append(matched, summary)
+		}
+	}
+	q.mu.Unlock()
+
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].CreatedAt.After(matched[j].CreatedAt)
+	})
+
+	if filter.Page < 1 {
+		filter.Page = 1
+	}
+	if filter.PageSize < 1 {
+		filter.PageSize = 20
+	}
+	list := JobList{Items: []JobSummary{}, Total: len(matched), Page: filter.Page, PageSize: filter.PageSize}
+	start := (filter.Page - 1) * filter.PageSize
+	if start < len(matched) {
+		end := min(start+filter.PageSize, len(matched))
+		list.Items = matched[start:end]
+	}
+	return list
+}
+
+// Summary returns the lightweight listing view of the job.
+func (j *Job) Summary() JobSummary {
+	return summarize(j)
+}
+
+func summarize(job *Job) JobSummary {
+	version := requestVersion(job.Request)
+	if job.Result != nil {
+		version = job.Result.Version
+	}
+	modules := append([]string{}, job.Request.ModuleNames...)
+	for _, custom := range job.Request.CustomModules {
+		modules = append(modules, custom.Name)
+	}
+	return JobSummary{
+		ID:          job.ID,
+		CreatedAt:   job.CreatedAt,
+		Status:      job.Status,
+		Version:     version,
+		Modules:     modules,
+		Priority:    job.Request.Priority,
+		Requester:   job.Requester,
+		Error:       job.Error,
+		HasArtifact: job.ArtifactPath != "",
+
+		Position:       job.Position,
+		EstimatedStart: job.EstimatedStart,
+	}
+}
+
+func requestVersion(req BuildRequest) string {
+	if version := strings.TrimSpace(req.TargetVersion); version != "" {
+		return version
+	}
+	if parsed, err := parser.ParseNginxV(req.Output); err == nil {
+		return parsed.Version
+	}
+	return ""
+}
+
+func (f ListFilter) match(summary JobSummary) bool {
+	if len(f.Statuses) > 0 {
+		found := false
+		for _, status := range f.Statuses {
+			if summary.Status == status {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.Version != "" && summary.Version != f.Version {
+		return false
+	}
+	if f.Module != "" {
+		found := false
+		for _, name := range summary.Modules {
+			if name == f.Module {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if !f.Since.IsZero() && summary.CreatedAt.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && summary.CreatedAt.After(f.Until) {
+		return false
+	}
+	return true
+}
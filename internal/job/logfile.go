@@ -0,0 +1,45 @@
+package job
+
+import (
+	"compress/gzip"
+	"fmt"
+	"os"
+	"time"
+)
+
+const logFileName = "build.log.gz"
+
+// logFile keeps the complete, untrimmed job output on disk; Job.Logs only
+// holds the tail for live display.
+type logFile struct {
+	file *os.File
+	gz   *gzip.Writer
+}
+
+func openLogFile(path string) (*logFile, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &logFile{file: file, gz: gzip.NewWriter(file)}, nil
+}
+
+func (l *logFile) writeLine(line LogLine) {
+	step := line.Step
+	if step == "" {
+		step = "-"
+	}
+	fmt.Fprintf(l.gz, "%s [%s] [%s] %s\n", line.Time.Format(time.RFC3339Nano), line.Stream, step, line.Text)
+}
+
+func (l *logFile) flush() {
+	_ = l.gz.Flush()
+}
+
+func (l *logFile) close() error {
+	if err := l.gz.Close(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
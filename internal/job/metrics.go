@@ -0,0 +1,43 @@
+package job
+
+import "sync"
+
+// Metrics counts lifecycle events since the process started.
+type Metrics struct {
+	mu     sync.Mutex
+	counts map[EventType]int64
+}
+
+type MetricsSnapshot struct {
+	Queued      int64 `json:"queued"`
+	Started     int64 `json:"started"`
+	Succeeded   int64 `json:"succeeded"`
+	Failed      int64 `json:"failed"`
+	Cancelled   int64 `json:"cancelled"`
+	Interrupted int64 `json:"interrupted"`
+	LogLines    int64 `json:"logLines"`
+}
+
+func NewMetrics(bus *Bus) *Metrics {
+	m := &Metrics{counts: make(map[EventType]int64)}
+	bus.Subscribe(nil, func(event Event) {
+		m.mu.Lock()
+		m.counts[event.Type]++
+		m.mu.Unlock()
+	})
+	return m
+}
+
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return MetricsSnapshot{
+		Queued:      m.counts[EventJobQueued],
+		Started:     m.counts[EventJobStarted],
+		Succeeded:   m.counts[EventJobSucceeded],
+		Failed:      m.counts[EventJobFailed],
+		Cancelled:   m.counts[EventJobCancelled],
+		Interrupted: m.counts[EventJobInterrupted],
+		LogLines:    m.counts[EventLogLine],
+	}
+}
@@ -0,0 +1,341 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"nginx-automake/internal/modules"
+	"nginx-automake/internal/parser"
+	"nginx-automake/internal/sandbox"
+)
+
+// planJobID stands in for the job ID in the paths of a dry-run plan.
+const planJobID = "<job-id>"
+
+// Command is one step of a build plan. Builtin commands are carried out
+// in-process; Name and Args then describe the equivalent shell command.
+type Command struct {
+	Step        string   `json:"step"`
+	Description string   `json:"description"`
+	Dir         string   `json:"dir"`
+	Name        string   `json:"name"`
+	Args        []string `json:"args"`
+	Env         []string `json:"env,omitempty"`
+	Sandboxed   bool     `json:"sandboxed,omitempty"`
+	Builtin     bool     `json:"builtin,omitempty"`
+	// Timeout bounds this command alone; the job's timeout still applies.
+	Timeout Duration `json:"timeout,omitempty"`
+
+	hook    string
+	sandbox *sandbox.Spec
+}
+
+type PlannedModule struct {
+	Name   string `json:"name"`
+	Flag   string `json:"flag"`
+	Path   string `json:"path"`
+	Repo   string `json:"repo,omitempty"`
+	Ref    string `json:"ref,omitempty"`
+	Custom bool   `json:"custom,omitempty"`
+	Clone  bool   `json:"clone"`
+}
+
+// Plan is everything a job will do, in order. Jobs execute their plan as
+// is, so a dry run through Queue.Plan shows exactly what would happen.
+type Plan struct {
+	Version       string          `json:"version"`
+	WorkDir       string          `json:"workDir"`
+	ConfigureArgs []string        `json:"configureArgs"`
+	Modules       []PlannedModule `json:"modules"`
+	Steps         []string        `json:"steps"`
+	Commands      []Command       `json:"commands"`
+	Artifact      string          `json:"artifact"`
+	Script        string          `json:"script"`
+	Warnings      []string        `json:"warnings"`
+	// Timeout is the job's overall deadline; zero means none.
+	Timeout Duration `json:"timeout"`
+}
+
+var stepDoneMessages = map[string]string{
+	"准备源代码": "源码就绪",
+	"准备模块":  "模块就绪",
+	"执行编译":  "编译完成",
+	"整理产物":  "产物已生成",
+}
+
+// Plan resolves req without executing anything. Paths use a placeholder in
+// place of the job ID.
+func (q *Queue) Plan(req BuildRequest) (*Plan, error) {
+	if err := q.ValidateRequest(req); err != nil {
+		return nil, err
+	}
+	if len(req.TargetVersions) > 0 {
+		return nil, errors.New("预览计划不支持多版本请求，请逐个版本使用 targetVersion 预览")
+	}
+	parsed, err := parser.ParseNginxV(req.Output)
+	if err != nil {
+		return nil, err
+	}
+	originalVersion := parsed.Version
+	if strings.TrimSpace(req.TargetVersion) != "" {
+		parsed.Version = strings.TrimSpace(req.TargetVersion)
+	}
+	hooks, err := q.resolveHooks(req.HookProfile)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := q.buildPlan(planJobID, req, parsed, hooks)
+	if err != nil {
+		return nil, err
+	}
+	plan.Timeout = Duration(q.jobTimeout(req))
+
+	if parsed.Version != originalVersion {
+		plan.warn("目标版本 %s 将替代原始版本 %s", parsed.Version, originalVersion)
+	}
+	if requested, _ := parseRequestTimeout(req.Timeout); requested > 0 && requested != time.Duration(plan.Timeout) {
+		plan.warn("请求的超时时间 %s 超过服务器上限，将按 %s 执行", requested, plan.Timeout)
+	}
+	for _, arg := range parsed.Arguments {
+		if strings.HasPrefix(arg, "--add-module=") || strings.HasPrefix(arg, "--add-dynamic-module=") {
+			plan.warn("原始参数 %s 将被移除，如需该模块请通过预设或自定义模块添加", arg)
+		}
+	}
+	seen := map[string]bool{}
+	for _, mod := range plan.Modules {
+		if seen[mod.Name] {
+			plan.warn("模块 %s 被重复添加", mod.Name)
+		}
+		seen[mod.Name] = true
+		if mod.Custom && mod.Ref == "" {
+			plan.warn("自定义模块 %s 未指定 ref，将使用仓库默认分支，结果可能无法复现", mod.Name)
+		}
+	}
+	if !req.Force {
+		q.mu.RLock()
+		existing := q.findReusableLocked(q.Fingerprint(req), q.pinned(req))
+		q.mu.RUnlock()
+		if existing != nil {
+			plan.warn("已存在相同配置的任务 %s，提交时将直接复用（可设置 force 强制重新编译）", existing.ID)
+		}
+	}
+	return plan, nil
+}
+
+func (p *Plan) warn(format string, args ...any) {
+	p.Warnings = append(p.Warnings, fmt.Sprintf(format, args...))
+}
+
+func (q *Queue) buildPlan(jobID string, req BuildRequest, parsed *parser.ParseResult, hooks []Hook) (*Plan, error) {
+	workDir := filepath.Join(q.workRoot, jobID)
+	nginxTar := filepath.Join(workDir, fmt.Sprintf("nginx-%s.tar.gz", parsed.Version))
+	srcDir := filepath.Join(workDir, fmt.Sprintf("nginx-%s", parsed.Version))
+	srcBinary := filepath.Join(srcDir, "objs", "nginx")
+	plan := &Plan{
+		Version:  parsed.Version,
+		WorkDir:  workDir,
+		Modules:  []PlannedModule{},
+		Artifact: filepath.Join(workDir, "artifact", fmt.Sprintf("nginx-%s", parsed.Version)),
+		Warnings: []string{},
+	}
+	for _, step := range stepsFor(hooks) {
+		plan.Steps = append(plan.Steps, step.Name)
+	}
+
+	plan.Commands = append(plan.Commands,
+		Command{
+			Step:        "准备源代码",
+			Description: "下载 Nginx 源码",
+			Dir:         workDir,
+			Name:        "curl",
+			Args:        []string{"-fSL", fmt.Sprintf("https://nginx.org/download/nginx-%s.tar.gz", parsed.Version), "-o", nginxTar},
+			Timeout:     Duration(q.stepTimeouts.Download),
+		},
+		Command{Step: "准备源代码", Description: "解压 Nginx 源码", Dir: workDir, Name: "tar", Args: []string{"-xzf", nginxTar}},
+	)
+	env := HookEnv{JobID: jobID, WorkDir: workDir, SrcDir: srcDir, Version: parsed.Version}
+	plan.Commands = append(plan.Commands, hookCommands(hooks, HookAfterExtract, env)...)
+
+	moduleArgs, err := q.planModules(plan, req, workDir)
+	if err != nil {
+		return nil, err
+	}
+	plan.ConfigureArgs = q.composeConfigureArgs(parsed.Arguments, moduleArgs)
+	plan.Script = buildScript(parsed.Version, plan.ConfigureArgs)
+	env.ConfigureArgs = plan.ConfigureArgs
+	plan.Commands = append(plan.Commands, hookCommands(hooks, HookAfterModules, env)...)
+
+	var spec *sandbox.Spec
+	if q.sandbox {
+		resolved, err := q.sandboxSpec(jobID, workDir, moduleArgs)
+		if err != nil {
+			return nil, err
+		}
+		spec = &resolved
+	}
+	plan.Commands = append(plan.Commands,
+		Command{
+			Step:        "执行编译",
+			Description: "执行 configure",
+			Dir:         srcDir,
+			Name:        "./configure",
+			Args:        plan.ConfigureArgs,
+			Timeout:     Duration(q.stepTimeouts.Configure),
+			Sandboxed:   spec != nil,
+			sandbox:     spec,
+		},
+		Command{
+			Step:        "执行编译",
+			Description: "执行 make",
+			Dir:         srcDir,
+			Name:        "make",
+			Args:        []string{"-j", strconv.Itoa(q.parallelism())},
+			Timeout:     Duration(q.stepTimeouts.Make),
+			Sandboxed:   spec != nil,
+			sandbox:     spec,
+		},
+	)
+	env.Binary = srcBinary
+	plan.Commands = append(plan.Commands, hookCommands(hooks, HookAfterMake, env)...)
+
+	plan.Commands = append(plan.Commands, Command{
+		Step:        "整理产物",
+		Description: "整理 nginx 二进制",
+		Dir:         workDir,
+		Name:        "cp",
+		Args:        []string{srcBinary, plan.Artifact},
+		Builtin:     true,
+	})
+	env.Artifact = plan.Artifact
+	plan.Commands = append(plan.Commands, hookCommands(hooks, HookAfterArtifact, env)...)
+	return plan, nil
+}
+
+// planModules resolves module paths and adds a clone command for every
+// module that is not already on disk.
+func (q *Queue) planModules(plan *Plan, req BuildRequest, workDir string) ([]string, error) {
+	var moduleArgs []string
+	add := func(mod modules.Module, custom bool) error {
+		modulePath, err := modules.ResolveModulePath(mod, q.modulesDir, workDir)
+		if err != nil {
+			return err
+		}
+		planned := PlannedModule{
+			Name:   mod.Name,
+			Flag:   modules.ModuleFlag(mod),
+			Path:   modulePath,
+			Repo:   mod.Repo,
+			Ref:    mod.Ref,
+			Custom: custom,
+		}
+		if mod.Path == "" {
+			planned.Clone = true
+		} else if _, err := os.Stat(modulePath); err != nil {
+			if mod.Repo == "" {
+				return fmt.Errorf("预置模块 %s 未找到，请提前下载到 %s", mod.Name, modulePath)
+			}
+			planned.Clone = true
+		}
+		if planned.Clone {
+			args := []string{"clone", "--depth", "1"}
+			if mod.Ref != "" {
+				args = append(args, "--branch", mod.Ref)
+			}
+			plan.Commands = append(plan.Commands, Command{
+				Step:        "准备模块",
+				Description: "克隆模块 " + mod.Name,
+				Dir:         workDir,
+				Name:        "git",
+				Args:        append(args, mod.Repo, modulePath),
+				Timeout:     Duration(q.stepTimeouts.Clone),
+			})
+		}
+		plan.Modules = append(plan.Modules, planned)
+		moduleArgs = append(moduleArgs, fmt.Sprintf("%s=%s", planned.Flag, modulePath))
+		return nil
+	}
+
+	for _, name := range req.ModuleNames {
+		mod, ok := q.registry.Get(name)
+		if !ok {
+			return nil, fmt.Errorf("模块 %s 未在预设列表中", name)
+		}
+		if err := add(mod, false); err != nil {
+			return nil, err
+		}
+	}
+	for _, custom := range req.CustomModules {
+		mod, err := modules.ValidateCustomModule(custom.Name, custom.Repo, custom.Flag, custom.Ref)
+		if err != nil {
+			return nil, err
+		}
+		if err := add(mod, true); err != nil {
+			return nil, err
+		}
+	}
+	return moduleArgs, nil
+}
+
+func hookCommands(hooks []Hook, point HookPoint, env HookEnv) []Command {
+	var commands []Command
+	for _, hook := range hooks {
+		if hook.Point != point {
+			continue
+		}
+		commands = append(commands, Command{
+			Step:        hook.StepName(),
+			Description: "执行 " + hook.Name,
+			Dir:         env.WorkDir,
+			Name:        hook.Path,
+			Args:        []string{},
+			Env: []string{
+				"AUTOMAKE_JOB_ID=" + env.JobID,
+				"AUTOMAKE_HOOK_POINT=" + string(point),
+				"AUTOMAKE_WORKDIR=" + env.WorkDir,
+				"AUTOMAKE_SRC_DIR=" + env.SrcDir,
+				"AUTOMAKE_NGINX_VERSION=" + env.Version,
+				"AUTOMAKE_CONFIGURE_ARGS=" + strings.Join(env.ConfigureArgs, " "),
+				"AUTOMAKE_BINARY=" + env.Binary,
+				"AUTOMAKE_ARTIFACT=" + env.Artifact,
+			},
+			hook: hook.Name,
+		})
+	}
+	return commands
+}
+
+// runPlan walks the plan step by step after the parse step; steps without
+// commands simply succeed.
+func (q *Queue) runPlan(ctx context.Context, job *Job, plan *Plan) error {
+	for _, step := range plan.Steps {
+		if step == "解析配置" {
+			continue
+		}
+		for _, cmd := range plan.Commands {
+			if cmd.Step != step {
+				continue
+			}
+			q.setStep(job.ID, step, StepRunning, cmd.Description)
+			q.appendLog(job.ID, cmd.Description)
+			if err := q.runCommand(ctx, job, cmd); err != nil {
+				if cmd.hook != "" {
+					err = fmt.Errorf("钩子 %s 执行失败: %w", cmd.hook, err)
+				}
+				q.setStep(job.ID, step, StepFailed, err.Error())
+				return err
+			}
+		}
+		message, ok := stepDoneMessages[step]
+		if !ok {
+			message = "执行完成"
+		}
+		q.setStep(job.ID, step, StepSuccess, message)
+	}
+	return nil
+}
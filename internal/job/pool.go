@@ -0,0 +1,76 @@
+package job
+
+import (
+	"sort"
+	"time"
+)
+
+type WorkerStatus string
+
+const (
+	WorkerIdle WorkerStatus = "idle"
+	WorkerBusy WorkerStatus = "busy"
+)
+
+type workerState struct {
+	ID    int          `json:"id"`
+	State WorkerStatus `json:"state"`
+	JobID string       `json:"jobId,omitempty"`
+	Since time.Time    `json:"since"`
+}
+
+type PoolStatus struct {
+	Workers  int            `json:"workers"`
+	Paused   bool           `json:"paused"`
+	Draining bool           `json:"draining"`
+	Queued   int            `json:"queued"`
+	Pool     []workerState  `json:"pool"`
+	Remote   []RemoteWorker `json:"remote"`
+}
+
+func (q *Queue) Start() {
+	q.Resize(q.workers)
+	go q.janitor()
+	go q.watchLeases()
+}
+
+func (q *Queue) Resize(workers int) {
+	if workers < 0 {
+		workers = 0
+	}
+	q.mu.Lock()
+	q.workers = workers
+	for !q.stopped && len(q.pool) < q.workers {
+		q.workerSeq++
+		w := &workerState{ID: q.workerSeq, State: WorkerIdle, Since: time.Now()}
+		q.pool[w.ID] = w
+		go q.worker(w)
+	}
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+func (q *Queue) SetPaused(paused bool) {
+	q.mu.Lock()
+	q.paused = paused
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+func (q *Queue) PoolStatus() PoolStatus {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	status := PoolStatus{
+		Workers:  q.workers,
+		Paused:   q.paused,
+		Draining: q.draining,
+		Queued:   q.pending.len(),
+		Pool:     make([]workerState, 0, len(q.pool)),
+		Remote:   q.remoteWorkersLocked(),
+	}
+	for _, w := range q.pool {
+		status.Pool = append(status.Pool, *w)
+	}
+	sort.Slice(status.Pool, func(i, j int) bool { return status.Pool[i].ID < status.Pool[j].ID })
+	return status
+}
@@ -8,6 +8,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net/mail"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -16,8 +19,10 @@ import (
 	"sync"
 	"time"
 
+	"nginx-automake/internal/cgroup"
 	"nginx-automake/internal/modules"
 	"nginx-automake/internal/parser"
+	"nginx-automake/internal/sandbox"
 )
 
 type Status string
@@ -25,10 +30,12 @@ type Status string
 type StepStatus string
 
 const (
-	StatusQueued  Status = "queued"
-	StatusRunning Status = "running"
-	StatusSuccess Status = "success"
-	StatusFailed  Status = "failed"
+	StatusQueued      Status = "queued"
+	StatusRunning     Status = "running"
+	StatusSuccess     Status = "success"
+	StatusFailed      Status = "failed"
+	StatusCancelled   Status = "cancelled"
+	StatusInterrupted Status = "interrupted"
 
 	StepPending StepStatus = "pending"
 	StepRunning StepStatus = "running"
@@ -38,9 +45,11 @@ const (
 )
 
 type Step struct {
-	Name    string     `json:"name"`
-	Status  StepStatus `json:"status"`
-	Message string     `json:"message"`
+	Name       string     `json:"name"`
+	Status     StepStatus `json:"status"`
+	Message    string     `json:"message"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
 }
 
 type Job struct {
@@ -48,12 +57,41 @@ type Job struct {
 	CreatedAt    time.Time           `json:"createdAt"`
 	Status       Status              `json:"status"`
 	Steps        []Step              `json:"steps"`
-	Logs         []string            `json:"logs"`
+	Logs         []LogLine           `json:"logs"`
+	LogOffset    int64               `json:"logOffset"`
 	Error        string              `json:"error"`
 	ArtifactPath string              `json:"artifactPath"`
 	Script       string              `json:"script"`
 	Result       *parser.ParseResult `json:"result"`
 	Request      BuildRequest        `json:"request"`
+	Requester    string              `json:"requester"`
+	RetryOf      string              `json:"retryOf,omitempty"`
+	Fingerprint  string              `json:"fingerprint"`
+	Evicted      bool                `json:"evicted,omitempty"`
+	LogPath      string              `json:"logPath,omitempty"`
+	Hooks        []Hook              `json:"hooks,omitempty"`
+	// Worker names the remote build worker holding the job's lease.
+	Worker string `json:"worker,omitempty"`
+	// TimedOut marks a failure caused by the job or a step running out of
+	// time rather than by a failing command.
+	TimedOut bool `json:"timedOut,omitempty"`
+	// Resumable marks a job interrupted by the latest shutdown; only these
+	// and jobs a crash left running are re-queued on the next start.
+	Resumable bool `json:"resumable,omitempty"`
+
+	StartedAt      *time.Time `json:"startedAt,omitempty"`
+	FinishedAt     *time.Time `json:"finishedAt,omitempty"`
+	Position       int        `json:"position,omitempty"`
+	EstimatedStart *time.Time `json:"estimatedStart,omitempty"`
+
+	cancel      context.CancelFunc
+	timeout     time.Duration
+	abortStatus Status
+	cgroup      *cgroup.Group
+	logFile     *logFile
+	// attachments are the submissions waiting for the job; they are stored
+	// but never shown by the API.
+	attachments []attachment
 }
 
 type BuildRequest struct {
@@ -61,176 +99,541 @@ type BuildRequest struct {
 	ModuleNames   []string          `json:"moduleNames"`
 	CustomModules []CustomModuleReq `json:"customModules"`
 	TargetVersion string            `json:"targetVersion"`
+	// TargetVersions fans the request out into one job per version, grouped
+	// by SubmitMatrix.
+	TargetVersions []string `json:"targetVersions,omitempty"`
+	Priority       Priority `json:"priority"`
+	Force          bool     `json:"force"`
+	// Webhooks are notified when this job finishes, in addition to the
+	// server-wide endpoints.
+	Webhooks []string `json:"webhooks,omitempty"`
+	// NotifyEmail receives a message when the job succeeds or fails.
+	NotifyEmail string `json:"notifyEmail,omitempty"`
+	// HookProfile adds the hooks under <HooksDir>/profiles/<name> to the
+	// server-wide ones.
+	HookProfile string `json:"hookProfile,omitempty"`
+	// Timeout replaces the server's build timeout for this job, e.g. "30m";
+	// it never exceeds the configured maximum.
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// Redacted returns the request without the fields only its submitter may
+// see, for responses anyone can read.
+func (r BuildRequest) Redacted() BuildRequest {
+	r.NotifyEmail = ""
+	r.Webhooks = nil
+	return r
 }
 
 type CustomModuleReq struct {
 	Name string `json:"name"`
 	Repo string `json:"repo"`
 	Flag string `json:"flag"`
+	Ref  string `json:"ref"`
+}
+
+var (
+	ErrJobNotFound = errors.New("任务不存在")
+	ErrJobFinished = errors.New("任务已结束，无法取消")
+	ErrQueueFull   = errors.New("编译队列已满，请稍后再试")
+	ErrOOMKilled   = errors.New("编译进程因内存不足被系统终止 (OOM)")
+)
+
+type Config struct {
+	Workers    int
+	Capacity   int
+	ModulesDir string
+	WorkRoot   string
+	Timeout    time.Duration
+	// MaxTimeout caps Timeout and the timeouts requests ask for; zero
+	// leaves them uncapped.
+	MaxTimeout   time.Duration
+	StepTimeouts StepTimeouts
+	CPUs         float64
+	Cgroups      *cgroup.Manager
+	Groups       *GroupStore
+	Sandbox      bool
+	HooksDir     string
+	// RequestWebhooks accepts BuildRequest.Webhooks; when false only the
+	// server-wide webhooks are notified.
+	RequestWebhooks bool
+	// LeaseTTL is how long a remote worker may stay silent before its
+	// leased jobs are re-queued.
+	LeaseTTL time.Duration
+
+	Retention      time.Duration
+	RetentionCount int
 }
 
 type Queue struct {
-	jobs       map[string]*Job
-	mu         sync.RWMutex
-	queue      chan *Job
-	workers    int
-	modulesDir string
-	workRoot   string
-	registry   *modules.Registry
-	timeout    time.Duration
-	history    *HistoryStore
+	jobs           map[string]*Job
+	mu             sync.RWMutex
+	cond           *sync.Cond
+	pending        *scheduler
+	events         *Bus
+	watching       map[string]int
+	workers        int
+	capacity       int
+	modulesDir     string
+	workRoot       string
+	registry       *modules.Registry
+	timeout        time.Duration
+	maxTimeout     time.Duration
+	stepTimeouts   StepTimeouts
+	cpus           float64
+	cgroups        *cgroup.Manager
+	sandbox        bool
+	hooksDir       string
+	requestHooks   bool
+	executor       Executor
+	remote         map[string]*RemoteWorker
+	leases         map[string]*lease
+	leaseTTL       time.Duration
+	retention      time.Duration
+	retentionCount int
+	history        *HistoryStore
+	store          *JobStore
+	groups         map[string]*Group
+	groupStore     *GroupStore
+	active         sync.WaitGroup
+	draining       bool
+	stopped        bool
+	paused         bool
+	pool           map[int]*workerState
+	workerSeq      int
 }
 
-func NewQueue(workers int, modulesDir, workRoot string, registry *modules.Registry, timeout time.Duration, history *HistoryStore) *Queue {
-	return &Queue{
-		jobs:       make(map[string]*Job),
-		queue:      make(chan *Job, 100),
-		workers:    workers,
-		modulesDir: modulesDir,
-		workRoot:   workRoot,
-		registry:   registry,
-		timeout:    timeout,
-		history:    history,
-	}
+func NewQueue(cfg Config, registry *modules.Registry, history *HistoryStore, store *JobStore) *Queue {
+	q := &Queue{
+		jobs:           make(map[string]*Job),
+		pending:        newScheduler(),
+		pool:           make(map[int]*workerState),
+		events:         NewBus(),
+		watching:       make(map[string]int),
+		workers:        cfg.Workers,
+		capacity:       cfg.Capacity,
+		modulesDir:     cfg.ModulesDir,
+		workRoot:       cfg.WorkRoot,
+		registry:       registry,
+		timeout:        cfg.Timeout,
+		maxTimeout:     cfg.MaxTimeout,
+		stepTimeouts:   cfg.StepTimeouts,
+		cpus:           cfg.CPUs,
+		cgroups:        cfg.Cgroups,
+		sandbox:        cfg.Sandbox,
+		hooksDir:       cfg.HooksDir,
+		requestHooks:   cfg.RequestWebhooks,
+		remote:         make(map[string]*RemoteWorker),
+		leases:         make(map[string]*lease),
+		leaseTTL:       cfg.LeaseTTL,
+		retention:      cfg.Retention,
+		retentionCount: cfg.RetentionCount,
+		history:        history,
+		store:          store,
+		groups:         make(map[string]*Group),
+		groupStore:     cfg.Groups,
+	}
+	if q.leaseTTL <= 0 {
+		q.leaseTTL = defaultLeaseTTL
+	}
+	q.cond = sync.NewCond(&q.mu)
+	q.executor = localExecutor{q: q}
+	if history != nil {
+		q.events.Subscribe(recordsHistory, func(event Event) {
+			_ = history.Append(newHistoryEntry(event.Job))
+		})
+	}
+	return q
 }
 
-func (q *Queue) Start() {
-	for i := 0; i < q.workers; i++ {
-		go q.worker()
+// recordsHistory selects the terminal events that end up in history; jobs
+// whose input could not even be parsed are left out.
+func recordsHistory(event Event) bool {
+	if !event.Type.Terminal() {
+		return false
 	}
+	return event.Type != EventJobFailed || event.Job.Result != nil
 }
 
-func (q *Queue) Enqueue(req BuildRequest) (*Job, error) {
+func (q *Queue) Enqueue(req BuildRequest, requester string) (Submission, error) {
+	return q.submit(req, requester, false)
+}
+
+// Submit enqueues req unless an identical build is already queued, running
+// or finished with an artifact on disk, in which case that job is returned
+// and Reused is true. Setting req.Force always starts a fresh build.
+func (q *Queue) Submit(req BuildRequest, requester string) (Submission, error) {
+	return q.submit(req, requester, !req.Force)
+}
+
+func (q *Queue) submit(req BuildRequest, requester string, coalesce bool) (Submission, error) {
 	jobID, err := randomID()
 	if err != nil {
-		return nil, err
+		return Submission{}, err
 	}
+	handle, err := randomID()
+	if err != nil {
+		return Submission{}, err
+	}
+	if req.Priority == "" {
+		req.Priority = PriorityNormal
+	}
+	hooks, err := q.resolveHooks(req.HookProfile)
+	if err != nil {
+		return Submission{}, err
+	}
+	attached := attachment{Handle: handle, Requester: requester, NotifyEmail: req.NotifyEmail, Webhooks: req.Webhooks}
 	job := &Job{
-		ID:        jobID,
-		CreatedAt: time.Now(),
-		Status:    StatusQueued,
-		Steps: []Step{
-			{Name: "解析配置", Status: StepPending},
-			{Name: "准备源代码", Status: StepPending},
-			{Name: "准备模块", Status: StepPending},
-			{Name: "执行编译", Status: StepPending},
-			{Name: "整理产物", Status: StepPending},
-		},
-		Request: req,
+		ID:          jobID,
+		CreatedAt:   time.Now(),
+		Status:      StatusQueued,
+		Steps:       stepsFor(hooks),
+		Hooks:       hooks,
+		Request:     req,
+		Requester:   requester,
+		Fingerprint: q.Fingerprint(req),
+		attachments: []attachment{attached},
 	}
 	q.mu.Lock()
+	defer q.mu.Unlock()
+	if coalesce {
+		if existing := q.findReusableLocked(job.Fingerprint, q.pinned(req)); existing != nil {
+			if existing.Status.Finished() {
+				return Submission{Job: existing, Reused: true}, nil
+			}
+			existing.attachments = append(existing.submissions(), attached)
+			q.persistLocked()
+			return Submission{Job: existing, Reused: true, Handle: handle}, nil
+		}
+	}
+	if q.draining {
+		return Submission{}, ErrDraining
+	}
+	if q.capacity > 0 && q.pending.len() >= q.capacity {
+		return Submission{}, ErrQueueFull
+	}
 	q.jobs[jobID] = job
-	q.mu.Unlock()
-	q.queue <- job
-	return job, nil
+	q.pending.push(job)
+	q.persistLocked()
+	q.publishLocked(EventJobQueued, job)
+	// Local workers and remote lease polls wait on the same condition; a
+	// single wake-up could land on a poll that is about to give up.
+	q.cond.Broadcast()
+	return Submission{Job: job, Handle: handle}, nil
+}
+
+func (s *Step) touch(now time.Time) {
+	switch s.Status {
+	case StepRunning:
+		if s.StartedAt == nil {
+			s.StartedAt = &now
+		}
+	case StepSuccess, StepFailed, StepSkipped:
+		if s.StartedAt == nil {
+			s.StartedAt = &now
+		}
+		if s.FinishedAt == nil {
+			s.FinishedAt = &now
+		}
+	}
+}
+
+func defaultSteps() []Step {
+	return []Step{
+		{Name: "解析配置", Status: StepPending},
+		{Name: "准备源代码", Status: StepPending},
+		{Name: "准备模块", Status: StepPending},
+		{Name: "执行编译", Status: StepPending},
+		{Name: "整理产物", Status: StepPending},
+	}
+}
+
+func (q *Queue) Restore(requeueInterrupted bool) error {
+	if err := q.restoreGroups(); err != nil {
+		return err
+	}
+	if q.store == nil {
+		return nil
+	}
+	list, err := q.store.Load()
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, job := range list {
+		q.jobs[job.ID] = job
+		for i := range job.Logs {
+			if job.Logs[i].Seq == 0 {
+				job.Logs[i].Seq = job.LogOffset + int64(i) + 1
+			}
+		}
+		switch job.Status {
+		case StatusQueued:
+			q.pending.push(job)
+		case StatusRunning, StatusInterrupted:
+			resumable := job.Status == StatusRunning || job.Resumable
+			job.Resumable = false
+			if requeueInterrupted && resumable {
+				q.requeueLocked(job, "服务重启，任务重新排队")
+				continue
+			}
+			if job.Status == StatusRunning {
+				job.Status = StatusInterrupted
+				job.Error = "服务重启，任务被中断"
+				q.publishLocked(EventJobInterrupted, job)
+			}
+		}
+	}
+	q.persistLocked()
+	return nil
+}
+
+// requeueLocked puts a job that was interrupted mid-build back in the queue
+// with a fresh work directory and step list.
+func (q *Queue) requeueLocked(job *Job, message string) {
+	_ = os.RemoveAll(filepath.Join(q.workRoot, job.ID))
+	job.Status = StatusQueued
+	job.Error = ""
+	job.Steps = stepsFor(job.Hooks)
+	job.Result = nil
+	job.Script = ""
+	job.Worker = ""
+	job.StartedAt = nil
+	job.FinishedAt = nil
+	job.cancel = nil
+	job.abortStatus = ""
+	q.appendLogLocked(job, StreamSystem, message)
+	q.pending.push(job)
+}
+
+func (q *Queue) persistLocked() {
+	if q.store == nil {
+		return
+	}
+	list := make([]*Job, 0, len(q.jobs))
+	for _, job := range q.jobs {
+		// Only the tail of the log is stored; the job's log file has the
+		// rest.
+		copied := job.snapshot()
+		copied.LogOffset += int64(len(job.Logs) - len(copied.Logs))
+		list = append(list, copied)
+	}
+	_ = q.store.Save(list)
 }
 
 func (q *Queue) Get(id string) (*Job, bool) {
-	q.mu.RLock()
-	defer q.mu.RUnlock()
+	q.mu.Lock()
+	defer q.mu.Unlock()
 	job, ok := q.jobs[id]
+	if ok && job.Status == StatusQueued {
+		q.refreshEstimatesLocked()
+	}
+	if !ok && q.history != nil {
+		if entry, found := q.history.Get(id); found {
+			return jobFromHistory(entry), true
+		}
+	}
 	return job, ok
 }
 
-func (q *Queue) worker() {
-	for job := range q.queue {
-		q.updateStatus(job.ID, StatusRunning)
-		ctx := context.Background()
-		var cancel context.CancelFunc
-		if q.timeout > 0 {
-			ctx, cancel = context.WithTimeout(ctx, q.timeout)
-		}
-		if err := q.runJob(ctx, job); err != nil {
-			q.failJob(job.ID, err)
-		} else {
-			q.updateStatus(job.ID, StatusSuccess)
+// Public returns a copy of the job with its request redacted.
+func (j *Job) Public() *Job {
+	copied := *j
+	copied.Request = j.Request.Redacted()
+	return &copied
+}
+
+// Cancel stops a job. While several submissions share the job, the one
+// identified by handle is only detached from it, with its notify address and
+// webhooks, and detached is true.
+func (q *Queue) Cancel(id, handle string) (detached bool, err error) {
+	q.mu.Lock()
+	job, ok := q.jobs[id]
+	if !ok {
+		q.mu.Unlock()
+		return false, ErrJobNotFound
+	}
+	if !job.Status.Finished() && len(job.submissions()) > 1 {
+		defer q.mu.Unlock()
+		if err := q.detachLocked(job, handle); err != nil {
+			return false, err
 		}
+		return true, nil
+	}
+	switch job.Status {
+	case StatusQueued:
+		q.pending.remove(id)
+		q.abortJobLocked(job, StatusCancelled)
+		q.mu.Unlock()
+		return false, nil
+	case StatusRunning:
+		job.abortStatus = StatusCancelled
+		cancel := job.cancel
+		q.mu.Unlock()
 		if cancel != nil {
 			cancel()
 		}
+		return false, nil
+	default:
+		q.mu.Unlock()
+		return false, ErrJobFinished
+	}
+}
+
+func (q *Queue) next(w *workerState) (*Job, context.Context) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	w.State = WorkerIdle
+	w.JobID = ""
+	w.Since = time.Now()
+	for !q.stopped && len(q.pool) <= q.workers && (q.paused || q.draining || q.pending.len() == 0) {
+		q.cond.Wait()
+	}
+	if q.stopped || len(q.pool) > q.workers {
+		delete(q.pool, w.ID)
+		return nil, nil
+	}
+	job := q.pending.pop()
+	q.active.Add(1)
+	w.State = WorkerBusy
+	w.JobID = job.ID
+	w.Since = time.Now()
+
+	q.startLocked(job)
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if job.timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), job.timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	job.cancel = cancel
+	return job, ctx
+}
+
+func (q *Queue) startLocked(job *Job) {
+	now := time.Now()
+	job.Status = StatusRunning
+	job.StartedAt = &now
+	job.Position = 0
+	job.EstimatedStart = nil
+	job.timeout = q.jobTimeout(job.Request)
+	if requested, _ := parseRequestTimeout(job.Request.Timeout); requested > 0 && requested != job.timeout {
+		q.appendLogLocked(job, StreamSystem, fmt.Sprintf("请求的超时时间 %s 超过服务器上限，按 %s 执行", requested, job.timeout))
+	}
+	q.persistLocked()
+	q.publishLocked(EventJobStarted, job)
+}
+
+func (q *Queue) worker(w *workerState) {
+	for {
+		job, ctx := q.next(w)
+		if job == nil {
+			return
+		}
+		err := q.runJob(ctx, job)
+		q.mu.Lock()
+		job.cancel()
+		job.cancel = nil
+		aborted := job.abortStatus
+		q.mu.Unlock()
+		switch {
+		case err == nil:
+			q.completeJob(job.ID)
+		case aborted != "":
+			q.abortJob(job.ID, aborted)
+		default:
+			q.failJob(job.ID, err)
+		}
+		q.active.Done()
 	}
 }
 
 func (q *Queue) runJob(ctx context.Context, job *Job) error {
-	parsed, err := parser.ParseNginxV(job.Request.Output)
+	q.mu.RLock()
+	req, hooks := job.Request, job.Hooks
+	q.mu.RUnlock()
+	q.setStep(job.ID, "解析配置", StepRunning, "解析 nginx -V 输出")
+	parsed, err := parser.ParseNginxV(req.Output)
 	if err != nil {
 		q.setStep(job.ID, "解析配置", StepFailed, err.Error())
 		return err
 	}
-	if strings.TrimSpace(job.Request.TargetVersion) != "" {
-		parsed.Version = strings.TrimSpace(job.Request.TargetVersion)
+	if strings.TrimSpace(req.TargetVersion) != "" {
+		parsed.Version = strings.TrimSpace(req.TargetVersion)
 	}
-	q.setStep(job.ID, "解析配置", StepSuccess, "解析完成")
+	q.mu.Lock()
 	job.Result = parsed
-
-	workDir := filepath.Join(q.workRoot, job.ID)
-	if err := os.MkdirAll(workDir, 0o755); err != nil {
-		q.setStep(job.ID, "准备源代码", StepFailed, err.Error())
+	q.mu.Unlock()
+	plan, err := q.buildPlan(job.ID, req, parsed, hooks)
+	if err != nil {
+		q.setStep(job.ID, "解析配置", StepFailed, err.Error())
 		return err
 	}
+	q.mu.Lock()
+	job.Script = plan.Script
+	q.mu.Unlock()
+	q.setStep(job.ID, "解析配置", StepSuccess, "解析完成")
 
-	nginxTar := filepath.Join(workDir, fmt.Sprintf("nginx-%s.tar.gz", parsed.Version))
-	srcDir := filepath.Join(workDir, fmt.Sprintf("nginx-%s", parsed.Version))
-
-	q.setStep(job.ID, "准备源代码", StepRunning, "下载 Nginx 源码")
-	if err := q.runCommand(ctx, job.ID, workDir, "curl", "-fSL", fmt.Sprintf("https://nginx.org/download/nginx-%s.tar.gz", parsed.Version), "-o", nginxTar); err != nil {
-		q.setStep(job.ID, "准备源代码", StepFailed, err.Error())
-		return err
-	}
-	if err := q.runCommand(ctx, job.ID, workDir, "tar", "-xzf", nginxTar); err != nil {
+	workDir := plan.WorkDir
+	if err := os.MkdirAll(workDir, 0o755); err != nil {
 		q.setStep(job.ID, "准备源代码", StepFailed, err.Error())
 		return err
 	}
-	q.setStep(job.ID, "准备源代码", StepSuccess, "源码就绪")
-
-	q.setStep(job.ID, "准备模块", StepRunning, "同步模块")
-	moduleArgs, err := q.prepareModules(ctx, job, workDir)
-	if err != nil {
-		q.setStep(job.ID, "准备模块", StepFailed, err.Error())
-		return err
+	q.mu.Lock()
+	output, err := q.attachLogFileLocked(job, workDir)
+	q.mu.Unlock()
+	if err == nil {
+		defer func() {
+			q.mu.Lock()
+			job.logFile = nil
+			q.mu.Unlock()
+			_ = output.close()
+		}()
 	}
-	q.setStep(job.ID, "准备模块", StepSuccess, "模块就绪")
 
-	q.setStep(job.ID, "执行编译", StepRunning, "执行 configure")
-	configureArgs := q.composeConfigureArgs(parsed.Arguments, moduleArgs)
-	job.Script = buildScript(parsed.Version, configureArgs)
-	if err := q.runCommand(ctx, job.ID, srcDir, "./configure", configureArgs...); err != nil {
-		q.setStep(job.ID, "执行编译", StepFailed, err.Error())
-		return err
-	}
-	q.appendLog(job.ID, "configure 完成，开始编译")
-	if err := q.runCommand(ctx, job.ID, srcDir, "make", "-j", fmt.Sprintf("%d", max(1, int64(runtime.NumCPU())))); err != nil {
-		q.setStep(job.ID, "执行编译", StepFailed, err.Error())
+	if q.cgroups != nil {
+		group, err := q.cgroups.Create("job-" + job.ID)
+		if err != nil {
+			err = fmt.Errorf("创建 cgroup 失败: %w", err)
+			q.setStep(job.ID, "准备源代码", StepFailed, err.Error())
+			return err
+		}
+		q.mu.Lock()
+		job.cgroup = group
+		q.mu.Unlock()
+		defer func() {
+			q.mu.Lock()
+			job.cgroup = nil
+			q.mu.Unlock()
+			_ = group.Remove()
+		}()
+	}
+
+	if err := q.runPlan(ctx, job, plan); err != nil {
 		return err
 	}
-	q.setStep(job.ID, "执行编译", StepSuccess, "编译完成")
+	q.mu.Lock()
+	job.ArtifactPath = plan.Artifact
+	q.mu.Unlock()
+	return nil
+}
 
-	q.setStep(job.ID, "整理产物", StepRunning, "整理 nginx 二进制")
-	artifactDir := filepath.Join(workDir, "artifact")
-	if err := os.MkdirAll(artifactDir, 0o755); err != nil {
-		q.setStep(job.ID, "整理产物", StepFailed, err.Error())
-		return err
-	}
-	srcBinary := filepath.Join(srcDir, "objs", "nginx")
-	artifact := filepath.Join(artifactDir, fmt.Sprintf("nginx-%s", parsed.Version))
-	if err := copyFile(srcBinary, artifact); err != nil {
-		q.setStep(job.ID, "整理产物", StepFailed, err.Error())
-		return err
+// attachLogFileLocked opens the full log in workDir and replays the lines
+// kept in memory so far; appended lines go to the file from then on.
+func (q *Queue) attachLogFileLocked(job *Job, workDir string) (*logFile, error) {
+	logPath := filepath.Join(workDir, logFileName)
+	output, err := openLogFile(logPath)
+	if err != nil {
+		return nil, err
 	}
-	job.ArtifactPath = artifact
-	q.setStep(job.ID, "整理产物", StepSuccess, "产物已生成")
-	if q.history != nil {
-		entry := HistoryEntry{
-			ID:        job.ID,
-			CreatedAt: job.CreatedAt,
-			Version:   parsed.Version,
-			Modules:   append([]string{}, job.Request.ModuleNames...),
-			Status:    string(StatusSuccess),
-			Artifact:  artifact,
-		}
-		_ = q.history.Append(entry)
+	job.logFile = output
+	job.LogPath = logPath
+	for _, line := range job.Logs {
+		output.writeLine(line)
 	}
-	return nil
+	return output, nil
 }
 
 func (q *Queue) composeConfigureArgs(original []string, moduleArgs []string) []string {
@@ -244,60 +647,46 @@ func (q *Queue) composeConfigureArgs(original []string, moduleArgs []string) []s
 	return append(filtered, moduleArgs...)
 }
 
-func (q *Queue) prepareModules(ctx context.Context, job *Job, workDir string) ([]string, error) {
-	var moduleArgs []string
-	for _, name := range job.Request.ModuleNames {
-		mod, ok := q.registry.Get(name)
-		if !ok {
-			return nil, fmt.Errorf("模块 %s 未在预设列表中", name)
-		}
-		modulePath, err := modules.ResolveModulePath(mod, q.modulesDir, workDir)
-		if err != nil {
-			return nil, err
-		}
-		if mod.Path == "" {
-			if err := q.cloneModule(ctx, job.ID, mod.Repo, modulePath); err != nil {
-				return nil, err
-			}
-		} else if _, err := os.Stat(modulePath); err != nil {
-			if mod.Repo == "" {
-				return nil, fmt.Errorf("预置模块 %s 未找到，请提前下载到 %s", name, modulePath)
-			}
-			if err := q.cloneModule(ctx, job.ID, mod.Repo, modulePath); err != nil {
-				return nil, err
-			}
-		}
-		moduleArgs = append(moduleArgs, fmt.Sprintf("%s=%s", modules.ModuleFlag(mod), modulePath))
+func (q *Queue) sandboxSpec(jobID, workDir string, moduleArgs []string) (sandbox.Spec, error) {
+	absWorkDir, err := filepath.Abs(workDir)
+	if err != nil {
+		return sandbox.Spec{}, err
 	}
-
-	for _, custom := range job.Request.CustomModules {
-		mod, err := modules.ValidateCustomModule(custom.Name, custom.Repo, custom.Flag)
-		if err != nil {
-			return nil, err
-		}
-		modulePath, err := modules.ResolveModulePath(mod, q.modulesDir, workDir)
-		if err != nil {
-			return nil, err
+	absWorkRoot, err := filepath.Abs(q.workRoot)
+	if err != nil {
+		return sandbox.Spec{}, err
+	}
+	spec := sandbox.Spec{
+		Root:    filepath.Join(absWorkRoot, ".sandbox", jobID),
+		WorkDir: absWorkDir,
+	}
+	if modulesDir, err := filepath.Abs(q.modulesDir); err == nil {
+		spec.ReadOnly = append(spec.ReadOnly, modulesDir)
+	}
+	for _, arg := range moduleArgs {
+		_, path, ok := strings.Cut(arg, "=")
+		if !ok {
+			continue
 		}
-		if err := q.cloneModule(ctx, job.ID, mod.Repo, modulePath); err != nil {
-			return nil, err
+		if path, err = filepath.Abs(path); err == nil && !strings.HasPrefix(path, absWorkDir+string(filepath.Separator)) {
+			spec.ReadOnly = append(spec.ReadOnly, path)
 		}
-		moduleArgs = append(moduleArgs, fmt.Sprintf("%s=%s", modules.ModuleFlag(mod), modulePath))
 	}
-
-	return moduleArgs, nil
+	return spec, nil
 }
 
-func (q *Queue) cloneModule(ctx context.Context, jobID, repo, dir string) error {
-	if _, err := os.Stat(dir); err == nil {
-		return nil
+func (q *Queue) execute(jobID string, cmd *exec.Cmd) error {
+	q.mu.RLock()
+	var group *cgroup.Group
+	if job, ok := q.jobs[jobID]; ok {
+		group = job.cgroup
+	}
+	q.mu.RUnlock()
+	oomBefore := 0
+	if group != nil {
+		group.Attach(cmd)
+		oomBefore = group.OOMKills()
 	}
-	return q.runCommand(ctx, jobID, filepath.Dir(dir), "git", "clone", "--depth", "1", repo, dir)
-}
-
-func (q *Queue) runCommand(ctx context.Context, jobID, dir, name string, args ...string) error {
-	cmd := exec.CommandContext(ctx, name, args...)
-	cmd.Dir = dir
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return err
@@ -313,35 +702,86 @@ func (q *Queue) runCommand(ctx context.Context, jobID, dir, name string, args ..
 
 	wg := sync.WaitGroup{}
 	wg.Add(2)
-	go q.streamOutput(jobID, stdout, &wg)
-	go q.streamOutput(jobID, stderr, &wg)
+	go q.streamOutput(jobID, StreamStdout, stdout, &wg)
+	go q.streamOutput(jobID, StreamStderr, stderr, &wg)
 	wg.Wait()
 
 	if err := cmd.Wait(); err != nil {
+		if group != nil && group.OOMKills() > oomBefore {
+			return fmt.Errorf("%w，内存限制 %s", ErrOOMKilled, cgroup.FormatSize(q.cgroups.Memory))
+		}
 		return err
 	}
 	return nil
 }
 
-func (q *Queue) streamOutput(jobID string, reader io.Reader, wg *sync.WaitGroup) {
+// parallelism derives make -j from the per-job CPU budget instead of the
+// whole host, so concurrent workers do not oversubscribe the machine.
+func (q *Queue) parallelism() int {
+	q.mu.RLock()
+	workers := q.workers
+	q.mu.RUnlock()
+	jobs := runtime.NumCPU()
+	if q.cpus > 0 {
+		jobs = int(math.Ceil(q.cpus))
+	} else if workers > 1 {
+		jobs /= workers
+	}
+	return int(max(1, int64(jobs)))
+}
+
+func (q *Queue) streamOutput(jobID string, stream LogStream, reader io.Reader, wg *sync.WaitGroup) {
 	defer wg.Done()
 	scanner := bufio.NewScanner(reader)
 	for scanner.Scan() {
-		q.appendLog(jobID, scanner.Text())
+		q.appendOutput(jobID, stream, scanner.Text())
 	}
 }
 
-func (q *Queue) appendLog(jobID, line string) {
+func (q *Queue) appendLog(jobID, text string) {
+	q.appendOutput(jobID, StreamSystem, text)
+}
+
+func (q *Queue) appendOutput(jobID string, stream LogStream, text string) {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 	job, ok := q.jobs[jobID]
 	if !ok {
 		return
 	}
+	line := q.appendLogLocked(job, stream, text)
+	q.events.Publish(Event{Type: EventLogLine, JobID: jobID, Log: &line})
+}
+
+func (q *Queue) appendLogLocked(job *Job, stream LogStream, text string) LogLine {
+	return q.addLineLocked(job, LogLine{Time: time.Now(), Stream: stream, Step: currentStep(job), Text: text})
+}
+
+// addLineLocked numbers line and appends it to the job's log, trimming the
+// in-memory window; the log file keeps every line.
+func (q *Queue) addLineLocked(job *Job, line LogLine) LogLine {
 	if len(job.Logs) > 2000 {
-		job.Logs = job.Logs[len(job.Logs)-1500:]
+		dropped := len(job.Logs) - 1500
+		job.Logs = job.Logs[dropped:]
+		job.LogOffset += int64(dropped)
 	}
+	line.Seq = job.LogOffset + int64(len(job.Logs)) + 1
 	job.Logs = append(job.Logs, line)
+	if job.logFile != nil {
+		job.logFile.writeLine(line)
+	}
+	return line
+}
+
+// currentStep attributes a log line to the step that is running when it is
+// written; steps run one at a time.
+func currentStep(job *Job) string {
+	for _, step := range job.Steps {
+		if step.Status == StepRunning {
+			return step.Name
+		}
+	}
+	return ""
 }
 
 func (q *Queue) setStep(jobID, name string, status StepStatus, message string) {
@@ -351,21 +791,38 @@ func (q *Queue) setStep(jobID, name string, status StepStatus, message string) {
 	if !ok {
 		return
 	}
+	var changed *Step
 	for i := range job.Steps {
 		if job.Steps[i].Name == name {
 			job.Steps[i].Status = status
 			job.Steps[i].Message = message
+			job.Steps[i].touch(time.Now())
+			step := job.Steps[i]
+			changed = &step
 			break
 		}
 	}
+	if job.logFile != nil {
+		job.logFile.flush()
+	}
+	q.persistLocked()
+	if changed != nil {
+		q.events.Publish(Event{Type: EventStepChanged, JobID: jobID, Job: job.snapshot(), Step: changed})
+	}
 }
 
-func (q *Queue) updateStatus(jobID string, status Status) {
+func (q *Queue) completeJob(jobID string) {
 	q.mu.Lock()
 	defer q.mu.Unlock()
-	if job, ok := q.jobs[jobID]; ok {
-		job.Status = status
+	job, ok := q.jobs[jobID]
+	if !ok {
+		return
 	}
+	finishedAt := time.Now()
+	job.Status = StatusSuccess
+	job.FinishedAt = &finishedAt
+	q.persistLocked()
+	q.publishLocked(EventJobSucceeded, job)
 }
 
 func (q *Queue) failJob(jobID string, err error) {
@@ -375,18 +832,73 @@ func (q *Queue) failJob(jobID string, err error) {
 	if !ok {
 		return
 	}
+	finishedAt := time.Now()
 	job.Status = StatusFailed
 	job.Error = err.Error()
-	if q.history != nil && job.Result != nil {
-		entry := HistoryEntry{
-			ID:        job.ID,
-			CreatedAt: job.CreatedAt,
-			Version:   job.Result.Version,
-			Modules:   append([]string{}, job.Request.ModuleNames...),
-			Status:    string(job.Status),
-			Error:     job.Error,
+	job.TimedOut = errors.Is(err, ErrTimeout)
+	job.FinishedAt = &finishedAt
+	q.persistLocked()
+	q.publishLocked(EventJobFailed, job)
+}
+
+func (q *Queue) abortJob(jobID string, status Status) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if job, ok := q.jobs[jobID]; ok {
+		q.abortJobLocked(job, status)
+	}
+}
+
+func (q *Queue) abortJobLocked(job *Job, status Status) {
+	finishedAt := time.Now()
+	job.Status = status
+	job.Error = "任务已取消"
+	if status == StatusInterrupted {
+		job.Error = "服务关闭，任务被中断"
+		job.Resumable = true
+	}
+	job.FinishedAt = &finishedAt
+	job.Position = 0
+	job.EstimatedStart = nil
+	for i := range job.Steps {
+		switch job.Steps[i].Status {
+		case StepPending:
+			job.Steps[i].Status = StepSkipped
+		case StepRunning, StepFailed:
+			job.Steps[i].Status = StepFailed
+			job.Steps[i].Message = job.Error
+			job.Steps[i].touch(finishedAt)
 		}
-		_ = q.history.Append(entry)
+	}
+	q.persistLocked()
+	if status == StatusInterrupted {
+		q.publishLocked(EventJobInterrupted, job)
+	} else {
+		q.publishLocked(EventJobCancelled, job)
+	}
+}
+
+func newHistoryEntry(job *Job) HistoryEntry {
+	version := requestVersion(job.Request)
+	if job.Result != nil {
+		version = job.Result.Version
+	}
+	req := job.Request
+	return HistoryEntry{
+		ID:          job.ID,
+		CreatedAt:   job.CreatedAt,
+		StartedAt:   job.StartedAt,
+		FinishedAt:  job.FinishedAt,
+		Version:     version,
+		Modules:     append([]string{}, job.Request.ModuleNames...),
+		Status:      string(job.Status),
+		Artifact:    job.ArtifactPath,
+		Error:       job.Error,
+		Request:     &req,
+		Steps:       append([]Step{}, job.Steps...),
+		Fingerprint: job.Fingerprint,
+		LogFile:     job.LogPath,
+		TimedOut:    job.TimedOut,
 	}
 }
 
@@ -435,5 +947,52 @@ func (q *Queue) ValidateRequest(req BuildRequest) error {
 	if strings.TrimSpace(req.TargetVersion) != "" && !parser.ValidVersion(req.TargetVersion) {
 		return errors.New("目标版本号格式不正确，例如 1.24.0")
 	}
+	if _, err := matrixVersions(req); err != nil {
+		return err
+	}
+	if _, err := parseRequestTimeout(req.Timeout); err != nil {
+		return err
+	}
+	if !req.Priority.Valid() {
+		return errors.New("优先级仅支持 high、normal 或 low")
+	}
+	if len(req.Webhooks) > 0 && !q.requestHooks {
+		return errors.New("服务器未启用提交时指定的 webhook")
+	}
+	if len(req.Webhooks) > maxWebhooks {
+		return fmt.Errorf("每个任务最多配置 %d 个 webhook", maxWebhooks)
+	}
+	for _, target := range req.Webhooks {
+		parsed, err := url.Parse(target)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("webhook 地址无效: %s", target)
+		}
+	}
+	if req.NotifyEmail != "" {
+		if addr, err := mail.ParseAddress(req.NotifyEmail); err != nil || addr.Address != req.NotifyEmail {
+			return errors.New("通知邮箱格式不正确")
+		}
+	}
 	return nil
 }
+
+const maxWebhooks = 5
+
+// mergeUnique collects the webhooks and notify addresses of the submissions
+// attached to a job.
+func mergeUnique(existing, extra []string) []string {
+	merged := append([]string{}, existing...)
+	for _, value := range extra {
+		found := false
+		for _, have := range merged {
+			if have == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, value)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,64 @@
+package job
+
+import "errors"
+
+var (
+	ErrJobNotFinished = errors.New("任务尚未结束，无法重试")
+	ErrNoRequest      = errors.New("该记录缺少原始编译请求，无法重新编译")
+)
+
+type RebuildOptions struct {
+	TargetVersion string   `json:"targetVersion"`
+	ModuleNames   []string `json:"moduleNames"`
+	Priority      Priority `json:"priority"`
+}
+
+func (o RebuildOptions) apply(req BuildRequest) BuildRequest {
+	if o.TargetVersion != "" {
+		req.TargetVersion = o.TargetVersion
+	}
+	if o.ModuleNames != nil {
+		req.ModuleNames = append([]string{}, o.ModuleNames...)
+	}
+	if o.Priority != "" {
+		req.Priority = o.Priority
+	}
+	return req
+}
+
+func (q *Queue) Retry(id string, opts RebuildOptions, requester string) (Submission, error) {
+	job, ok := q.Get(id)
+	if !ok {
+		return Submission{}, ErrJobNotFound
+	}
+	q.mu.RLock()
+	req := job.Request
+	status := job.Status
+	q.mu.RUnlock()
+	if !status.Finished() {
+		return Submission{}, ErrJobNotFinished
+	}
+	return q.resubmit(opts.apply(req), requester, id)
+}
+
+func (q *Queue) Rebuild(entry HistoryEntry, opts RebuildOptions, requester string) (Submission, error) {
+	if entry.Request == nil {
+		return Submission{}, ErrNoRequest
+	}
+	return q.resubmit(opts.apply(*entry.Request), requester, entry.ID)
+}
+
+func (q *Queue) resubmit(req BuildRequest, requester, origin string) (Submission, error) {
+	if err := q.ValidateRequest(req); err != nil {
+		return Submission{}, err
+	}
+	submission, err := q.Enqueue(req, requester)
+	if err != nil {
+		return Submission{}, err
+	}
+	q.mu.Lock()
+	submission.Job.RetryOf = origin
+	q.persistLocked()
+	q.mu.Unlock()
+	return submission, nil
+}
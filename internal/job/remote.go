@@ -0,0 +1,360 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"nginx-automake/internal/parser"
+)
+
+// defaultLeaseTTL applies when Config.LeaseTTL is not set.
+const defaultLeaseTTL = time.Minute
+
+var (
+	ErrWorkerUnknown = errors.New("构建节点未注册或已过期，请重新注册")
+	ErrLeaseLost     = errors.New("任务租约已失效")
+)
+
+// RemoteWorker is a build worker process that registered with this queue and
+// pulls jobs over HTTP instead of running them in a local goroutine.
+type RemoteWorker struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	RegisteredAt time.Time `json:"registeredAt"`
+	LastSeen     time.Time `json:"lastSeen"`
+	Jobs         []string  `json:"jobs"`
+}
+
+// Lease hands one queued job to a remote worker. The worker keeps the lease
+// alive by reporting at least every TTL; when it stops, the job is re-queued.
+type Lease struct {
+	JobID   string       `json:"jobId"`
+	Request BuildRequest `json:"request"`
+	Timeout Duration     `json:"timeout"`
+	TTL     Duration     `json:"ttl"`
+}
+
+// WorkerReport carries a leased job's progress: the worker's full step list
+// and the log lines written since the previous report.
+type WorkerReport struct {
+	Steps []Step    `json:"steps,omitempty"`
+	Logs  []LogLine `json:"logs,omitempty"`
+}
+
+// WorkerResult ends a lease. Abandoned hands the job back to the queue
+// instead of finishing it, e.g. when the worker shuts down.
+type WorkerResult struct {
+	Error     string              `json:"error,omitempty"`
+	TimedOut  bool                `json:"timedOut,omitempty"`
+	Abandoned bool                `json:"abandoned,omitempty"`
+	Result    *parser.ParseResult `json:"result,omitempty"`
+	Script    string              `json:"script,omitempty"`
+}
+
+type lease struct {
+	jobID    string
+	workerID string
+	expires  time.Time
+	// lastSeq is the highest worker log sequence already appended, so a
+	// report that is retried after a lost response adds nothing twice.
+	lastSeq  int64
+	artifact string
+}
+
+func (q *Queue) RegisterWorker(name string) (RemoteWorker, error) {
+	id, err := randomID()
+	if err != nil {
+		return RemoteWorker{}, err
+	}
+	if name == "" {
+		name = id
+	}
+	now := time.Now()
+	worker := &RemoteWorker{ID: id, Name: name, RegisteredAt: now, LastSeen: now, Jobs: []string{}}
+	q.mu.Lock()
+	q.remote[id] = worker
+	q.mu.Unlock()
+	return *worker, nil
+}
+
+// Lease waits up to wait for a queued job and leases it to the worker. It
+// returns nil when nothing could be dispatched in time or ctx is done first,
+// e.g. because the worker hung up; remote workers obey pause and drain just
+// like the local pool.
+func (q *Queue) Lease(ctx context.Context, workerID string, wait time.Duration) (*Lease, error) {
+	if limit := q.leaseTTL / 2; wait > limit {
+		wait = limit
+	}
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+	// Broadcasting under the lock keeps the wake-up from landing between the
+	// ctx check below and Wait.
+	stop := context.AfterFunc(ctx, func() {
+		q.mu.Lock()
+		q.cond.Broadcast()
+		q.mu.Unlock()
+	})
+	defer stop()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		worker, ok := q.remote[workerID]
+		if !ok {
+			return nil, ErrWorkerUnknown
+		}
+		worker.LastSeen = time.Now()
+		if q.stopped || ctx.Err() != nil {
+			return nil, nil
+		}
+		if !q.paused && !q.draining && q.pending.len() > 0 {
+			break
+		}
+		q.cond.Wait()
+	}
+
+	worker := q.remote[workerID]
+	job := q.pending.pop()
+	q.active.Add(1)
+	// Cancellation reaches the worker through the response to its next
+	// report.
+	job.cancel = func() {}
+	job.Worker = worker.Name
+	q.startLocked(job)
+	q.leases[job.ID] = &lease{jobID: job.ID, workerID: workerID, expires: time.Now().Add(q.leaseTTL)}
+	worker.Jobs = append(worker.Jobs, job.ID)
+
+	workDir := filepath.Join(q.workRoot, job.ID)
+	if err := os.MkdirAll(workDir, 0o755); err == nil {
+		_, _ = q.attachLogFileLocked(job, workDir)
+	}
+	line := q.appendLogLocked(job, StreamSystem, fmt.Sprintf("任务已分配给构建节点 %s", worker.Name))
+	q.events.Publish(Event{Type: EventLogLine, JobID: job.ID, Log: &line})
+	return &Lease{JobID: job.ID, Request: job.Request, Timeout: Duration(job.timeout), TTL: Duration(q.leaseTTL)}, nil
+}
+
+// leaseLocked returns the live lease of jobID held by workerID and extends
+// it.
+func (q *Queue) leaseLocked(workerID, jobID string) (*lease, *Job, error) {
+	l, ok := q.leases[jobID]
+	if !ok || l.workerID != workerID {
+		return nil, nil, ErrLeaseLost
+	}
+	job, ok := q.jobs[jobID]
+	if !ok {
+		return nil, nil, ErrLeaseLost
+	}
+	now := time.Now()
+	l.expires = now.Add(q.leaseTTL)
+	if worker, ok := q.remote[workerID]; ok {
+		worker.LastSeen = now
+	}
+	return l, job, nil
+}
+
+// Report applies a worker's progress to the leased job and tells the worker
+// whether the job has been cancelled in the meantime.
+func (q *Queue) Report(workerID, jobID string, report WorkerReport) (cancel bool, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	l, job, err := q.leaseLocked(workerID, jobID)
+	if err != nil {
+		return false, err
+	}
+	stepsChanged := false
+	if report.Steps != nil {
+		previous := make(map[string]Step, len(job.Steps))
+		for _, step := range job.Steps {
+			previous[step.Name] = step
+		}
+		job.Steps = append([]Step{}, report.Steps...)
+		for i := range job.Steps {
+			step := job.Steps[i]
+			if old, ok := previous[step.Name]; ok && old.Status == step.Status && old.Message == step.Message {
+				continue
+			}
+			stepsChanged = true
+			q.events.Publish(Event{Type: EventStepChanged, JobID: jobID, Job: job.snapshot(), Step: &step})
+		}
+	}
+	for _, remote := range report.Logs {
+		if remote.Seq <= l.lastSeq {
+			continue
+		}
+		l.lastSeq = remote.Seq
+		line := q.addLineLocked(job, LogLine{Time: remote.Time, Stream: remote.Stream, Step: remote.Step, Text: remote.Text})
+		q.events.Publish(Event{Type: EventLogLine, JobID: jobID, Log: &line})
+	}
+	if job.logFile != nil {
+		job.logFile.flush()
+	}
+	// Log lines live in the job's log file; the store only needs to follow
+	// the steps.
+	if stepsChanged {
+		q.persistLocked()
+	}
+	return job.abortStatus != "", nil
+}
+
+// StoreArtifact saves the binary a worker uploads for a leased job. name is
+// reduced to its base name.
+func (q *Queue) StoreArtifact(workerID, jobID, name string, body io.Reader) error {
+	name = filepath.Base(name)
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		return errors.New("产物文件名无效")
+	}
+	q.mu.Lock()
+	_, _, err := q.leaseLocked(workerID, jobID)
+	q.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(q.workRoot, jobID, "artifact", name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	output, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(output, body); err != nil {
+		output.Close()
+		return err
+	}
+	if err := output.Close(); err != nil {
+		return err
+	}
+	_ = os.Chmod(path, 0o755)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	l, _, err := q.leaseLocked(workerID, jobID)
+	if err != nil {
+		_ = os.Remove(path)
+		return err
+	}
+	l.artifact = path
+	return nil
+}
+
+// FinishLease ends a worker's lease with the outcome of the job. A job that
+// reports success without an uploaded artifact fails.
+func (q *Queue) FinishLease(workerID, jobID string, result WorkerResult) error {
+	q.mu.Lock()
+	l, job, err := q.leaseLocked(workerID, jobID)
+	if err != nil {
+		q.mu.Unlock()
+		return err
+	}
+	q.dropLeaseLocked(l)
+	if result.Abandoned && job.abortStatus == "" {
+		q.requeueLocked(job, fmt.Sprintf("构建节点 %s 退出，任务重新排队", job.Worker))
+		q.persistLocked()
+		q.publishLocked(EventJobQueued, job)
+		q.mu.Unlock()
+		q.cond.Broadcast()
+		q.active.Done()
+		return nil
+	}
+	job.cancel = nil
+	job.Result = result.Result
+	job.Script = result.Script
+	aborted := job.abortStatus
+	if result.Error == "" && aborted == "" {
+		if l.artifact == "" {
+			result.Error = "构建节点未上传编译产物"
+		} else {
+			job.ArtifactPath = l.artifact
+		}
+	}
+	q.mu.Unlock()
+
+	switch {
+	case aborted != "":
+		q.abortJob(jobID, aborted)
+	case result.Error == "":
+		q.completeJob(jobID)
+	case result.TimedOut:
+		q.failJob(jobID, &timeoutError{message: result.Error})
+	default:
+		q.failJob(jobID, errors.New(result.Error))
+	}
+	q.active.Done()
+	return nil
+}
+
+func (q *Queue) dropLeaseLocked(l *lease) {
+	delete(q.leases, l.jobID)
+	if worker, ok := q.remote[l.workerID]; ok {
+		for i, id := range worker.Jobs {
+			if id == l.jobID {
+				worker.Jobs = append(worker.Jobs[:i:i], worker.Jobs[i+1:]...)
+				break
+			}
+		}
+	}
+	if job, ok := q.jobs[l.jobID]; ok && job.logFile != nil {
+		_ = job.logFile.close()
+		job.logFile = nil
+	}
+}
+
+func (q *Queue) watchLeases() {
+	ticker := time.NewTicker(q.leaseTTL / 4)
+	defer ticker.Stop()
+	for range ticker.C {
+		q.expireLeases(time.Now())
+	}
+}
+
+// expireLeases re-queues the jobs of workers that stopped reporting and
+// forgets idle workers that stopped polling. A job cancelled while its
+// worker was silent is cancelled for good instead.
+func (q *Queue) expireLeases(now time.Time) {
+	q.mu.Lock()
+	requeued := false
+	for _, l := range q.leases {
+		if now.Before(l.expires) {
+			continue
+		}
+		job := q.jobs[l.jobID]
+		name := job.Worker
+		q.dropLeaseLocked(l)
+		if job.abortStatus != "" {
+			q.abortJobLocked(job, job.abortStatus)
+		} else {
+			q.requeueLocked(job, fmt.Sprintf("构建节点 %s 失联，任务重新排队", name))
+			q.persistLocked()
+			q.publishLocked(EventJobQueued, job)
+			requeued = true
+		}
+		q.active.Done()
+	}
+	for id, worker := range q.remote {
+		if len(worker.Jobs) == 0 && now.Sub(worker.LastSeen) > q.leaseTTL {
+			delete(q.remote, id)
+		}
+	}
+	q.mu.Unlock()
+	if requeued {
+		q.cond.Broadcast()
+	}
+}
+
+func (q *Queue) remoteWorkersLocked() []RemoteWorker {
+	list := make([]RemoteWorker, 0, len(q.remote))
+	for _, worker := range q.remote {
+		copied := *worker
+		copied.Jobs = append([]string{}, worker.Jobs...)
+		list = append(list, copied)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].RegisteredAt.Before(list[j].RegisteredAt) })
+	return list
+}
@@ -0,0 +1,86 @@
+package job
+
+import (
+	"sort"
+	"time"
+
+	"nginx-automake/internal/parser"
+)
+
+const evictInterval = time.Minute
+
+func (q *Queue) janitor() {
+	ticker := time.NewTicker(evictInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		q.evict(time.Now())
+	}
+}
+
+// evict drops finished jobs from memory once they are older than the
+// retention window or exceed the retention count. They stay reachable
+// through the history store.
+func (q *Queue) evict(now time.Time) {
+	if q.retention <= 0 && q.retentionCount <= 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var finished []*Job
+	for _, job := range q.jobs {
+		if job.Status.Finished() && q.watching[job.ID] == 0 {
+			finished = append(finished, job)
+		}
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return finishedAt(finished[i]).After(finishedAt(finished[j]))
+	})
+	evicted := 0
+	for i, job := range finished {
+		expired := q.retention > 0 && now.Sub(finishedAt(job)) > q.retention
+		overflow := q.retentionCount > 0 && i >= q.retentionCount
+		if expired || overflow {
+			delete(q.jobs, job.ID)
+			evicted++
+		}
+	}
+	if evicted > 0 {
+		q.persistLocked()
+	}
+}
+
+func finishedAt(job *Job) time.Time {
+	if job.FinishedAt != nil {
+		return *job.FinishedAt
+	}
+	return job.CreatedAt
+}
+
+func jobFromHistory(entry HistoryEntry) *Job {
+	job := &Job{
+		ID:           entry.ID,
+		CreatedAt:    entry.CreatedAt,
+		StartedAt:    entry.StartedAt,
+		FinishedAt:   entry.FinishedAt,
+		Status:       Status(entry.Status),
+		Steps:        append([]Step{}, entry.Steps...),
+		Logs:         []LogLine{},
+		Error:        entry.Error,
+		ArtifactPath: entry.Artifact,
+		Fingerprint:  entry.Fingerprint,
+		LogPath:      entry.LogFile,
+		TimedOut:     entry.TimedOut,
+		Evicted:      true,
+	}
+	if entry.Request != nil {
+		job.Request = *entry.Request
+		if parsed, err := parser.ParseNginxV(entry.Request.Output); err == nil {
+			job.Result = parsed
+		}
+	}
+	if job.Result == nil {
+		job.Result = &parser.ParseResult{}
+	}
+	job.Result.Version = entry.Version
+	return job
+}
@@ -0,0 +1,137 @@
+package job
+
+type Priority string
+
+const (
+	PriorityHigh   Priority = "high"
+	PriorityNormal Priority = "normal"
+	PriorityLow    Priority = "low"
+)
+
+var priorityLevels = []Priority{PriorityHigh, PriorityNormal, PriorityLow}
+
+func (p Priority) Valid() bool {
+	return p == "" || p == PriorityHigh || p == PriorityNormal || p == PriorityLow
+}
+
+func (p Priority) level() int {
+	switch p {
+	case PriorityHigh:
+		return 0
+	case PriorityLow:
+		return 2
+	}
+	return 1
+}
+
+// scheduler hands out queued jobs by priority level and, within a level,
+// round-robins between requesters so a bulk submission cannot starve others.
+type scheduler struct {
+	levels []*fairQueue
+	size   int
+}
+
+type fairQueue struct {
+	order []string
+	jobs  map[string][]*Job
+}
+
+func newScheduler() *scheduler {
+	s := &scheduler{}
+	for range priorityLevels {
+		s.levels = append(s.levels, &fairQueue{jobs: make(map[string][]*Job)})
+	}
+	return s
+}
+
+func (s *scheduler) len() int {
+	return s.size
+}
+
+func (s *scheduler) push(job *Job) {
+	s.levels[job.Request.Priority.level()].push(job)
+	s.size++
+}
+
+func (s *scheduler) pop() *Job {
+	for _, level := range s.levels {
+		if job := level.pop(); job != nil {
+			s.size--
+			return job
+		}
+	}
+	return nil
+}
+
+func (s *scheduler) remove(id string) bool {
+	for _, level := range s.levels {
+		if level.remove(id) {
+			s.size--
+			return true
+		}
+	}
+	return false
+}
+
+// ordered returns the queued jobs in the order pop would hand them out.
+func (s *scheduler) ordered() []*Job {
+	list := make([]*Job, 0, s.size)
+	for _, level := range s.levels {
+		clone := &fairQueue{order: append([]string{}, level.order...), jobs: make(map[string][]*Job, len(level.jobs))}
+		for requester, jobs := range level.jobs {
+			clone.jobs[requester] = append([]*Job{}, jobs...)
+		}
+		for job := clone.pop(); job != nil; job = clone.pop() {
+			list = append(list, job)
+		}
+	}
+	return list
+}
+
+func (f *fairQueue) push(job *Job) {
+	if len(f.jobs[job.Requester]) == 0 {
+		f.order = append(f.order, job.Requester)
+	}
+	f.jobs[job.Requester] = append(f.jobs[job.Requester], job)
+}
+
+func (f *fairQueue) pop() *Job {
+	if len(f.order) == 0 {
+		return nil
+	}
+	requester := f.order[0]
+	f.order = f.order[1:]
+	jobs := f.jobs[requester]
+	job := jobs[0]
+	if len(jobs) > 1 {
+		f.jobs[requester] = jobs[1:]
+		f.order = append(f.order, requester)
+	} else {
+		delete(f.jobs, requester)
+	}
+	return job
+}
+
+func (f *fairQueue) remove(id string) bool {
+	for requester, jobs := range f.jobs {
+		for i, job := range jobs {
+			if job.ID != id {
+				continue
+			}
+			jobs = append(jobs[:i:i], jobs[i+1:]...)
+			if len(jobs) > 0 {
+				f.jobs[requester] = jobs
+				return true
+			}
+			delete(f.jobs, requester)
+			for k, name := range f.order {
+				if name == requester {
+					f.order = append(f.order[:k], f.order[k+1:]...)
+					break
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package job
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+type DurationStats struct {
+	Count         int     `json:"count"`
+	MedianSeconds float64 `json:"medianSeconds"`
+	P95Seconds    float64 `json:"p95Seconds"`
+}
+
+type BuildStats struct {
+	Total    DurationStats            `json:"total"`
+	Steps    map[string]DurationStats `json:"steps"`
+	Versions map[string]DurationStats `json:"versions"`
+	Modules  map[string]DurationStats `json:"modules"`
+}
+
+func (h *HistoryStore) Stats() BuildStats {
+	var total []time.Duration
+	steps := map[string][]time.Duration{}
+	versions := map[string][]time.Duration{}
+	modules := map[string][]time.Duration{}
+
+	for _, entry := range h.List() {
+		for _, step := range entry.Steps {
+			if step.Status == StepSuccess && step.StartedAt != nil && step.FinishedAt != nil {
+				steps[step.Name] = append(steps[step.Name], step.FinishedAt.Sub(*step.StartedAt))
+			}
+		}
+		if entry.Status != string(StatusSuccess) || entry.StartedAt == nil || entry.FinishedAt == nil {
+			continue
+		}
+		duration := entry.FinishedAt.Sub(*entry.StartedAt)
+		total = append(total, duration)
+		if entry.Version != "" {
+			versions[entry.Version] = append(versions[entry.Version], duration)
+		}
+		for _, name := range entry.Modules {
+			modules[name] = append(modules[name], duration)
+		}
+		if entry.Request != nil {
+			for _, custom := range entry.Request.CustomModules {
+				modules[custom.Name] = append(modules[custom.Name], duration)
+			}
+		}
+	}
+
+	return BuildStats{
+		Total:    summarizeDurations(total),
+		Steps:    summarizeGroups(steps),
+		Versions: summarizeGroups(versions),
+		Modules:  summarizeGroups(modules),
+	}
+}
+
+func summarizeGroups(groups map[string][]time.Duration) map[string]DurationStats {
+	result := make(map[string]DurationStats, len(groups))
+	for name, durations := range groups {
+		result[name] = summarizeDurations(durations)
+	}
+	return result
+}
+
+func summarizeDurations(durations []time.Duration) DurationStats {
+	if len(durations) == 0 {
+		return DurationStats{}
+	}
+	sorted := append([]time.Duration{}, durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return DurationStats{
+		Count:         len(sorted),
+		MedianSeconds: percentile(sorted, 0.5).Seconds(),
+		P95Seconds:    percentile(sorted, 0.95).Seconds(),
+	}
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	idx := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return sorted[idx]
+}
@@ -0,0 +1,79 @@
+package job
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// storedJob adds what the API never shows to a persisted job.
+type storedJob struct {
+	*Job
+	Attachments []attachment `json:"attachments,omitempty"`
+}
+
+type JobStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewJobStore(path string) *JobStore {
+	return &JobStore{path: path}
+}
+
+func (s *JobStore) Load() ([]*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var stored []storedJob
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+	list := make([]*Job, 0, len(stored))
+	for _, entry := range stored {
+		entry.Job.attachments = entry.Attachments
+		list = append(list, entry.Job)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list, nil
+}
+
+func (s *JobStore) Save(list []*Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	stored := make([]storedJob, 0, len(list))
+	for _, job := range list {
+		stored = append(stored, storedJob{Job: job, Attachments: job.attachments})
+	}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
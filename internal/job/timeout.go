@@ -0,0 +1,117 @@
+package job
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrTimeout matches failures caused by a job or step deadline rather than
+// by the command itself.
+var ErrTimeout = errors.New("执行超时")
+
+// StepTimeouts bounds single commands of a build; zero leaves a command to
+// the job's overall timeout.
+type StepTimeouts struct {
+	Download  time.Duration
+	Clone     time.Duration
+	Configure time.Duration
+	Make      time.Duration
+}
+
+// Duration is a time.Duration that reads and writes JSON as a string such as
+// "30m0s", the format BuildRequest.Timeout takes.
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+type timeoutError struct {
+	message string
+}
+
+func newTimeoutError(what string, limit time.Duration) error {
+	return &timeoutError{message: fmt.Sprintf("%s超时（限制 %s），已终止", what, limit)}
+}
+
+func (e *timeoutError) Error() string {
+	return e.message
+}
+
+func (e *timeoutError) Is(target error) bool {
+	return target == ErrTimeout
+}
+
+// parseRequestTimeout reads BuildRequest.Timeout; empty means the server
+// default.
+func parseRequestTimeout(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		return 0, errors.New("超时时间格式不正确，例如 30m 或 1h30m")
+	}
+	return timeout, nil
+}
+
+// jobTimeout is the deadline a job runs under: its requested timeout or
+// the server default, capped by the configured maximum.
+func (q *Queue) jobTimeout(req BuildRequest) time.Duration {
+	timeout := q.timeout
+	if requested, err := parseRequestTimeout(req.Timeout); err == nil && requested > 0 {
+		timeout = requested
+	}
+	if q.maxTimeout > 0 && (timeout <= 0 || timeout > q.maxTimeout) {
+		timeout = q.maxTimeout
+	}
+	return timeout
+}
+
+// runCommand runs one plan command under its own deadline, if any, on top of
+// the job's, and reports a missed deadline as a timeout instead of the
+// error of the killed process.
+func (q *Queue) runCommand(ctx context.Context, job *Job, cmd Command) error {
+	runCtx := ctx
+	limit := time.Duration(cmd.Timeout)
+	if limit > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, limit)
+		defer cancel()
+	}
+	err := q.executor.Run(runCtx, job.ID, cmd)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		q.mu.RLock()
+		jobLimit := job.timeout
+		q.mu.RUnlock()
+		return newTimeoutError("任务", jobLimit)
+	case errors.Is(runCtx.Err(), context.DeadlineExceeded):
+		return newTimeoutError(cmd.Description+" ", limit)
+	}
+	return err
+}
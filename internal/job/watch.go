@@ -0,0 +1,175 @@
+package job
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type LogStream string
+
+const (
+	StreamStdout LogStream = "stdout"
+	StreamStderr LogStream = "stderr"
+	StreamSystem LogStream = "system"
+)
+
+type LogLine struct {
+	Seq    int64     `json:"seq"`
+	Time   time.Time `json:"time"`
+	Stream LogStream `json:"stream"`
+	Step   string    `json:"step,omitempty"`
+	Text   string    `json:"text"`
+}
+
+// UnmarshalJSON also accepts the plain strings older job files stored.
+func (l *LogLine) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*l = LogLine{Stream: StreamSystem, Text: text}
+		return nil
+	}
+	type plain LogLine
+	return json.Unmarshal(data, (*plain)(l))
+}
+
+// LogFilter narrows a log page to one stream and/or one step.
+type LogFilter struct {
+	Stream LogStream
+	Step   string
+}
+
+func (f LogFilter) match(line LogLine) bool {
+	if f.Stream != "" && line.Stream != f.Stream {
+		return false
+	}
+	if f.Step != "" && line.Step != f.Step {
+		return false
+	}
+	return true
+}
+
+type Snapshot struct {
+	Status Status    `json:"status"`
+	Error  string    `json:"error"`
+	Steps  []Step    `json:"steps"`
+	Logs   []LogLine `json:"logs"`
+}
+
+type LogPage struct {
+	Lines   []LogLine `json:"lines"`
+	Next    int64     `json:"next"`
+	Dropped bool      `json:"dropped"`
+	Status  Status    `json:"status"`
+}
+
+func (s Status) Finished() bool {
+	switch s {
+	case StatusSuccess, StatusFailed, StatusCancelled, StatusInterrupted:
+		return true
+	}
+	return false
+}
+
+// lookupLocked finds a job in memory or, once it has been evicted, in
+// history.
+func (q *Queue) lookupLocked(id string) (*Job, bool) {
+	if job, ok := q.jobs[id]; ok {
+		return job, true
+	}
+	if q.history != nil {
+		if entry, found := q.history.Get(id); found {
+			return jobFromHistory(entry), true
+		}
+	}
+	return nil, false
+}
+
+// Watch returns a channel that is poked whenever job id changes; callers
+// pull the new state with Snapshot. An evicted job never changes, so its
+// channel is never poked.
+func (q *Queue) Watch(id string) (<-chan struct{}, func(), bool) {
+	q.mu.Lock()
+	job, ok := q.lookupLocked(id)
+	if ok && !job.Evicted {
+		q.watching[id]++
+	}
+	q.mu.Unlock()
+	if !ok {
+		return nil, nil, false
+	}
+	if job.Evicted {
+		return make(chan struct{}), func() {}, true
+	}
+	ch := make(chan struct{}, 1)
+	unsubscribe := q.events.Subscribe(func(event Event) bool {
+		return event.JobID == id
+	}, func(Event) {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	})
+	stop := func() {
+		unsubscribe()
+		q.mu.Lock()
+		if q.watching[id]--; q.watching[id] <= 0 {
+			delete(q.watching, id)
+		}
+		q.mu.Unlock()
+	}
+	return ch, stop, true
+}
+
+func (q *Queue) Snapshot(id string, afterSeq int64) (Snapshot, bool) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	job, ok := q.lookupLocked(id)
+	if !ok {
+		return Snapshot{}, false
+	}
+	snapshot := Snapshot{
+		Status: job.Status,
+		Error:  job.Error,
+		Steps:  append([]Step{}, job.Steps...),
+	}
+	start := afterSeq - job.LogOffset
+	if start < 0 {
+		start = 0
+	}
+	if start < int64(len(job.Logs)) {
+		snapshot.Logs = append(snapshot.Logs, job.Logs[start:]...)
+	}
+	return snapshot, true
+}
+
+func (q *Queue) Logs(id string, afterSeq int64, limit int, filter LogFilter) (LogPage, bool) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	job, ok := q.lookupLocked(id)
+	if !ok {
+		return LogPage{}, false
+	}
+	if afterSeq < 0 {
+		afterSeq = 0
+	}
+	page := LogPage{
+		Lines:   []LogLine{},
+		Next:    afterSeq,
+		Dropped: afterSeq < job.LogOffset || job.Evicted,
+		Status:  job.Status,
+	}
+	start := afterSeq - job.LogOffset
+	if start < 0 {
+		start = 0
+	}
+	// Next advances past filtered-out lines too, so a filtered tail does not
+	// rescan the same range on every call.
+	for i := start; i < int64(len(job.Logs)) && len(page.Lines) < limit; i++ {
+		line := job.Logs[i]
+		page.Next = line.Seq
+		if filter.match(line) {
+			page.Lines = append(page.Lines, line)
+		}
+	}
+	return page, true
+}
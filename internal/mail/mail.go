@@ -0,0 +1,180 @@
+package mail
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"nginx-automake/internal/job"
+)
+
+// tailLines is how many of the last log lines a failure mail quotes.
+const tailLines = 30
+
+type Config struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	// BaseURL is prepended to download links; links stay relative when empty.
+	BaseURL string
+	Timeout time.Duration
+}
+
+// Mailer emails the notify addresses of every submission waiting for a job
+// when it succeeds or fails.
+type Mailer struct {
+	cfg Config
+}
+
+func New(cfg Config) *Mailer {
+	if cfg.Port == 0 {
+		cfg.Port = 25
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 30 * time.Second
+	}
+	cfg.BaseURL = strings.TrimRight(cfg.BaseURL, "/")
+	return &Mailer{cfg: cfg}
+}
+
+func (m *Mailer) Enabled() bool {
+	return m.cfg.Host != "" && m.cfg.From != ""
+}
+
+// Subscribe sends a message for every succeeded or failed job on bus that
+// asked for one.
+func (m *Mailer) Subscribe(bus *job.Bus) {
+	if !m.Enabled() {
+		return
+	}
+	bus.Subscribe(func(event job.Event) bool {
+		if event.Type != job.EventJobSucceeded && event.Type != job.EventJobFailed {
+			return false
+		}
+		return len(event.Job.NotifyEmails()) > 0
+	}, func(event job.Event) {
+		subject, body := m.compose(event)
+		// One message per address, so requesters sharing a build do not
+		// see each other's addresses.
+		for _, to := range event.Job.NotifyEmails() {
+			if err := m.Send(to, subject, body); err != nil {
+				log.Printf("发送任务 %s 的通知邮件到 %s 失败: %v", event.JobID, to, err)
+			}
+		}
+	})
+}
+
+func (m *Mailer) compose(event job.Event) (string, string) {
+	summary := event.Job.Summary()
+	var body strings.Builder
+	fmt.Fprintf(&body, "任务 ID：%s\nNginx 版本：%s\n", event.JobID, summary.Version)
+	if len(summary.Modules) > 0 {
+		fmt.Fprintf(&body, "模块：%s\n", strings.Join(summary.Modules, ", "))
+	}
+	if event.Job.StartedAt != nil && event.Job.FinishedAt != nil {
+		fmt.Fprintf(&body, "耗时：%s\n", event.Job.FinishedAt.Sub(*event.Job.StartedAt).Round(time.Second))
+	}
+
+	if event.Type == job.EventJobSucceeded {
+		fmt.Fprintf(&body, "\n下载地址：%s/api/jobs/%s/download\n", m.cfg.BaseURL, event.JobID)
+		if event.Job.Script != "" {
+			fmt.Fprintf(&body, "\n编译脚本：\n\n%s", event.Job.Script)
+		}
+		return fmt.Sprintf("[nginx-automake] 编译成功：nginx %s", summary.Version), body.String()
+	}
+
+	for _, step := range event.Job.Steps {
+		if step.Status == job.StepFailed {
+			fmt.Fprintf(&body, "\n失败步骤：%s\n", step.Name)
+			break
+		}
+	}
+	fmt.Fprintf(&body, "错误信息：%s\n", event.Job.Error)
+	logs := event.Job.Logs
+	if len(logs) > tailLines {
+		logs = logs[len(logs)-tailLines:]
+	}
+	if len(logs) > 0 {
+		fmt.Fprintf(&body, "\n最后 %d 行日志：\n\n", len(logs))
+		for _, line := range logs {
+			fmt.Fprintf(&body, "[%s] %s\n", line.Stream, line.Text)
+		}
+	}
+	fmt.Fprintf(&body, "\n完整日志：%s/api/jobs/%s/log\n", m.cfg.BaseURL, event.JobID)
+	if event.Job.TimedOut {
+		return fmt.Sprintf("[nginx-automake] 编译超时：nginx %s", summary.Version), body.String()
+	}
+	return fmt.Sprintf("[nginx-automake] 编译失败：nginx %s", summary.Version), body.String()
+}
+
+// Send delivers a plain-text UTF-8 message. STARTTLS is used when the server
+// offers it, and authentication only when a username is configured.
+func (m *Mailer) Send(to, subject, body string) error {
+	addr := net.JoinHostPort(m.cfg.Host, strconv.Itoa(m.cfg.Port))
+	conn, err := net.DialTimeout("tcp", addr, m.cfg.Timeout)
+	if err != nil {
+		return err
+	}
+	_ = conn.SetDeadline(time.Now().Add(m.cfg.Timeout))
+	client, err := smtp.NewClient(conn, m.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: m.cfg.Host}); err != nil {
+			return err
+		}
+	}
+	if m.cfg.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", m.cfg.Username, m.cfg.Password, m.cfg.Host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(m.cfg.From); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(m.message(to, subject, body)); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+func (m *Mailer) message(to, subject, body string) []byte {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", m.cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.BEncoding.Encode("UTF-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+	encoded := base64.StdEncoding.EncodeToString([]byte(body))
+	for len(encoded) > 76 {
+		msg.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	msg.WriteString(encoded + "\r\n")
+	return msg.Bytes()
+}
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
@@ -17,13 +16,17 @@ type Module struct {
 	Description string `json:"description"`
 	Flag        string `json:"flag"`
 	Path        string `json:"path,omitempty"`
+	Ref         string `json:"ref,omitempty"`
 }
 
 type Registry struct {
 	modules map[string]Module
 }
 
-var validModuleName = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+var (
+	validModuleName = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+	validRef        = regexp.MustCompile(`^[a-zA-Z0-9._][a-zA-Z0-9._/-]*$`)
+)
 
 func LoadRegistry(data []byte) (*Registry, error) {
 	var list []Module
@@ -53,7 +56,7 @@ func (r *Registry) Get(name string) (Module, bool) {
 	return mod, ok
 }
 
-func ValidateCustomModule(name, repo, flag string) (Module, error) {
+func ValidateCustomModule(name, repo, flag, ref string) (Module, error) {
 	if strings.TrimSpace(name) == "" {
 		return Module{}, errors.New("模块名称不能为空")
 	}
@@ -72,7 +75,10 @@ func ValidateCustomModule(name, repo, flag string) (Module, error) {
 	if flag != "add-module" && flag != "add-dynamic-module" {
 		return Module{}, errors.New("模块类型仅支持 add-module 或 add-dynamic-module")
 	}
-	return Module{Name: name, Repo: repo, Flag: flag}, nil
+	if ref != "" && !validRef.MatchString(ref) {
+		return Module{}, errors.New("模块版本（ref）仅支持分支或标签名称")
+	}
+	return Module{Name: name, Repo: repo, Flag: flag, Ref: ref}, nil
 }
 
 func ResolveModulePath(mod Module, modulesDir string, workDir string) (string, error) {
@@ -85,11 +91,7 @@ func ResolveModulePath(mod Module, modulesDir string, workDir string) (string, e
 	if mod.Repo == "" {
 		return "", fmt.Errorf("模块 %s 没有仓库地址", mod.Name)
 	}
-	cloneDir := filepath.Join(workDir, "modules", mod.Name)
-	if err := os.MkdirAll(filepath.Dir(cloneDir), 0o755); err != nil {
-		return "", err
-	}
-	return cloneDir, nil
+	return filepath.Join(workDir, "modules", mod.Name), nil
 }
 
 func ModuleFlag(mod Module) string {
@@ -0,0 +1,24 @@
+package sandbox
+
+import "errors"
+
+// Command is the hidden subcommand the server re-executes itself with to set
+// up the mount namespace before handing over to configure/make.
+const Command = "__sandbox"
+
+var ErrUnsupported = errors.New("当前平台不支持命名空间沙箱")
+
+// Spec describes what the sandboxed process may see: the system directories
+// read-only, WorkDir read-write and ReadOnly as extra read-only binds.
+type Spec struct {
+	Root     string   `json:"root"`
+	WorkDir  string   `json:"workDir"`
+	ReadOnly []string `json:"readOnly"`
+	Dir      string   `json:"dir"`
+	Args     []string `json:"args"`
+	Env      []string `json:"env"`
+}
+
+var systemDirs = []string{"/usr", "/bin", "/sbin", "/lib", "/lib32", "/lib64", "/libx32", "/etc", "/opt"}
+
+var devices = []string{"/dev/null", "/dev/zero", "/dev/full", "/dev/random", "/dev/urandom"}
@@ -0,0 +1,219 @@
+package sandbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+)
+
+const (
+	stNoSuid     = 0x2
+	stNoDev      = 0x4
+	stNoExec     = 0x8
+	stNoAtime    = 0x400
+	stNoDirAtime = 0x800
+	stRelatime   = 0x1000
+)
+
+// Wrap rewrites cmd so that it runs through the sandbox helper inside fresh
+// user, mount, pid and network namespaces.
+func Wrap(cmd *exec.Cmd, spec Spec) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	spec.Args = cmd.Args
+	spec.Dir = cmd.Dir
+	spec.Env = cmd.Env
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(spec.Root, 0o700); err != nil {
+		return err
+	}
+	cmd.Path = self
+	cmd.Args = []string{self, Command, string(data)}
+	cmd.Err = nil
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWNET | syscall.CLONE_NEWPID
+	cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+	cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+	cmd.SysProcAttr.GidMappingsEnableSetgroups = false
+	return nil
+}
+
+// Main runs inside the new namespaces: it builds a minimal root file system,
+// pivots into it and execs the wrapped command. It never returns.
+func Main(args []string) {
+	if len(args) != 1 {
+		fail(fmt.Errorf("参数错误"))
+	}
+	var spec Spec
+	if err := json.Unmarshal([]byte(args[0]), &spec); err != nil {
+		fail(err)
+	}
+	if err := setup(spec); err != nil {
+		fail(err)
+	}
+	path, err := exec.LookPath(spec.Args[0])
+	if err != nil {
+		fail(err)
+	}
+	fail(syscall.Exec(path, spec.Args, spec.Env))
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+	os.Exit(125)
+}
+
+func setup(spec Spec) error {
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("make / private: %w", err)
+	}
+	root := spec.Root
+	if err := syscall.Mount("tmpfs", root, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=755,size=16m"); err != nil {
+		return fmt.Errorf("mount root tmpfs: %w", err)
+	}
+
+	for _, dir := range systemDirs {
+		info, err := os.Lstat(dir)
+		if err != nil {
+			continue
+		}
+		target := filepath.Join(root, dir)
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err := os.Readlink(dir)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := bindMount(dir, target, true); err != nil {
+			return err
+		}
+	}
+
+	for _, dev := range devices {
+		if _, err := os.Stat(dev); err != nil {
+			continue
+		}
+		if err := bindMount(dev, filepath.Join(root, dev), false); err != nil {
+			return err
+		}
+	}
+
+	procDir := filepath.Join(root, "proc")
+	if err := os.MkdirAll(procDir, 0o755); err != nil {
+		return err
+	}
+	if err := syscall.Mount("proc", procDir, "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("mount proc: %w", err)
+	}
+	tmpDir := filepath.Join(root, "tmp")
+	if err := os.MkdirAll(tmpDir, 0o1777); err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", tmpDir, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+		return fmt.Errorf("mount tmp: %w", err)
+	}
+
+	for _, path := range spec.ReadOnly {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if err := bindMount(path, filepath.Join(root, path), true); err != nil {
+			return err
+		}
+	}
+	if err := bindMount(spec.WorkDir, filepath.Join(root, spec.WorkDir), false); err != nil {
+		return err
+	}
+
+	if err := os.Chdir(root); err != nil {
+		return err
+	}
+	if err := os.Mkdir(".oldroot", 0o700); err != nil {
+		return err
+	}
+	if err := syscall.PivotRoot(".", ".oldroot"); err != nil {
+		return fmt.Errorf("pivot_root: %w", err)
+	}
+	if err := os.Chdir("/"); err != nil {
+		return err
+	}
+	if err := syscall.Unmount("/.oldroot", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("unmount old root: %w", err)
+	}
+	if err := os.Remove("/.oldroot"); err != nil {
+		return err
+	}
+	if err := syscall.Mount("", "/", "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV, ""); err != nil {
+		return fmt.Errorf("remount root read-only: %w", err)
+	}
+	return os.Chdir(spec.Dir)
+}
+
+func bindMount(src, dst string, readOnly bool) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		err = os.MkdirAll(dst, 0o755)
+	} else {
+		if err = os.MkdirAll(filepath.Dir(dst), 0o755); err == nil {
+			var file *os.File
+			if file, err = os.OpenFile(dst, os.O_CREATE|os.O_WRONLY, 0o644); err == nil {
+				err = file.Close()
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := syscall.Mount(src, dst, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind %s: %w", src, err)
+	}
+	if !readOnly {
+		return nil
+	}
+	flags := uintptr(syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY) | lockedFlags(src)
+	if err := syscall.Mount("", dst, "", flags, ""); err != nil {
+		return fmt.Errorf("remount %s read-only: %w", src, err)
+	}
+	return nil
+}
+
+// lockedFlags returns the mount flags of path that an unprivileged user
+// namespace is not allowed to clear when remounting.
+func lockedFlags(path string) uintptr {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0
+	}
+	var flags uintptr
+	mapping := map[int64]uintptr{
+		stNoSuid:     syscall.MS_NOSUID,
+		stNoDev:      syscall.MS_NODEV,
+		stNoExec:     syscall.MS_NOEXEC,
+		stNoAtime:    syscall.MS_NOATIME,
+		stNoDirAtime: syscall.MS_NODIRATIME,
+		stRelatime:   syscall.MS_RELATIME,
+	}
+	for stFlag, ms := range mapping {
+		if int64(st.Flags)&stFlag != 0 {
+			flags |= ms
+		}
+	}
+	return flags
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package sandbox
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+func Wrap(cmd *exec.Cmd, spec Spec) error {
+	return ErrUnsupported
+}
+
+func Main(args []string) {
+	fmt.Fprintf(os.Stderr, "sandbox: %v\n", ErrUnsupported)
+	os.Exit(125)
+}
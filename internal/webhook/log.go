@@ -0,0 +1,117 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"nginx-automake/internal/job"
+)
+
+// maxLoggedJobs bounds the delivery log the same way history is bounded.
+const maxLoggedJobs = 200
+
+type Delivery struct {
+	ID         string        `json:"id"`
+	URL        string        `json:"url"`
+	Event      job.EventType `json:"event"`
+	Attempt    int           `json:"attempt"`
+	StatusCode int           `json:"statusCode,omitempty"`
+	Success    bool          `json:"success"`
+	Error      string        `json:"error,omitempty"`
+	Time       time.Time     `json:"time"`
+}
+
+// Redacted returns the delivery with its URL cut down to scheme and host,
+// since the path and query of a webhook often carry a secret.
+func (d Delivery) Redacted() Delivery {
+	target := "(无效地址)"
+	if parsed, err := url.Parse(d.URL); err == nil {
+		target = parsed.Scheme + "://" + parsed.Host
+	}
+	d.Error = strings.ReplaceAll(d.Error, d.URL, target)
+	d.URL = target
+	return d
+}
+
+type jobDeliveries struct {
+	JobID      string     `json:"jobId"`
+	Deliveries []Delivery `json:"deliveries"`
+}
+
+// DeliveryLog records every delivery attempt per job, newest job first.
+type DeliveryLog struct {
+	path string
+	mu   sync.Mutex
+	list []jobDeliveries
+}
+
+func NewDeliveryLog(path string) (*DeliveryLog, error) {
+	log := &DeliveryLog{path: path}
+	if path == "" {
+		return log, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return log, nil
+		}
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &log.list); err != nil {
+			return nil, err
+		}
+	}
+	return log, nil
+}
+
+func (l *DeliveryLog) Record(jobID string, delivery Delivery) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.list {
+		if l.list[i].JobID == jobID {
+			l.list[i].Deliveries = append(l.list[i].Deliveries, delivery)
+			_ = l.persistLocked()
+			return
+		}
+	}
+	l.list = append([]jobDeliveries{{JobID: jobID, Deliveries: []Delivery{delivery}}}, l.list...)
+	if len(l.list) > maxLoggedJobs {
+		l.list = l.list[:maxLoggedJobs]
+	}
+	_ = l.persistLocked()
+}
+
+func (l *DeliveryLog) Get(jobID string) []Delivery {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, entry := range l.list {
+		if entry.JobID == jobID {
+			return append([]Delivery{}, entry.Deliveries...)
+		}
+	}
+	return []Delivery{}
+}
+
+func (l *DeliveryLog) persistLocked() error {
+	if l.path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(l.path), 0o755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(l.list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := l.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.path)
+}
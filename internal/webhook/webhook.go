@@ -0,0 +1,270 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"nginx-automake/internal/job"
+)
+
+const (
+	HeaderEvent     = "X-Automake-Event"
+	HeaderDelivery  = "X-Automake-Delivery"
+	HeaderSignature = "X-Automake-Signature"
+)
+
+// ErrPrivateTarget is reported for a per-request webhook that resolves to a
+// loopback, link-local or private address.
+var ErrPrivateTarget = errors.New("webhook 地址指向本机或内网，已拒绝投递")
+
+type Config struct {
+	// URLs receive every finished job in addition to BuildRequest.Webhooks.
+	URLs []string
+	// Secret signs each body with HMAC-SHA256; empty disables signing.
+	Secret string
+	// BaseURL is prepended to artifact download links, e.g.
+	// https://builder.example.com. Links stay relative when empty.
+	BaseURL     string
+	MaxAttempts int
+	Backoff     time.Duration
+	Timeout     time.Duration
+	// AllowPrivate lets BuildRequest.Webhooks reach loopback, link-local and
+	// private addresses; URLs always may.
+	AllowPrivate bool
+}
+
+type Payload struct {
+	Event       job.EventType `json:"event"`
+	JobID       string        `json:"jobId"`
+	Status      job.Status    `json:"status"`
+	Version     string        `json:"version"`
+	Modules     []string      `json:"modules"`
+	ArtifactURL string        `json:"artifactUrl,omitempty"`
+	SHA256      string        `json:"sha256,omitempty"`
+	Error       string        `json:"error,omitempty"`
+	TimedOut    bool          `json:"timedOut,omitempty"`
+	FinishedAt  *time.Time    `json:"finishedAt,omitempty"`
+}
+
+type Dispatcher struct {
+	cfg    Config
+	client *http.Client
+	// public delivers per-request webhooks, refusing private addresses at
+	// connect time so redirects and DNS changes cannot get around it.
+	public *http.Client
+	log    *DeliveryLog
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func New(cfg Config, log *DeliveryLog) *Dispatcher {
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 1
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = 10 * time.Second
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	cfg.BaseURL = strings.TrimRight(cfg.BaseURL, "/")
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Dispatcher{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		public: &http.Client{Timeout: cfg.Timeout, Transport: publicTransport()},
+		log:    log,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Subscribe delivers a payload for every finished job on bus.
+func (d *Dispatcher) Subscribe(bus *job.Bus) {
+	bus.Subscribe(func(event job.Event) bool {
+		return event.Type.Terminal()
+	}, d.handle)
+}
+
+// Close abandons pending retries and waits for in-flight requests, which are
+// bounded by Config.Timeout.
+func (d *Dispatcher) Close() {
+	d.cancel()
+	d.wg.Wait()
+}
+
+func (d *Dispatcher) handle(event job.Event) {
+	targets := d.targets(event.Job.Webhooks())
+	if len(targets) == 0 {
+		return
+	}
+	body, err := json.Marshal(d.payload(event))
+	if err != nil {
+		return
+	}
+	for _, target := range targets {
+		d.wg.Add(1)
+		go func(target string) {
+			defer d.wg.Done()
+			d.deliver(event, target, body)
+		}(target)
+	}
+}
+
+func (d *Dispatcher) targets(extra []string) []string {
+	seen := map[string]struct{}{}
+	var targets []string
+	for _, target := range append(append([]string{}, d.cfg.URLs...), extra...) {
+		if _, ok := seen[target]; ok || target == "" {
+			continue
+		}
+		seen[target] = struct{}{}
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+func (d *Dispatcher) payload(event job.Event) Payload {
+	summary := event.Job.Summary()
+	payload := Payload{
+		Event:      event.Type,
+		JobID:      event.JobID,
+		Status:     event.Job.Status,
+		Version:    summary.Version,
+		Modules:    summary.Modules,
+		Error:      event.Job.Error,
+		TimedOut:   event.Job.TimedOut,
+		FinishedAt: event.Job.FinishedAt,
+	}
+	if event.Type == job.EventJobSucceeded && event.Job.ArtifactPath != "" {
+		payload.ArtifactURL = d.cfg.BaseURL + "/api/jobs/" + event.JobID + "/download"
+		payload.SHA256, _ = fileChecksum(event.Job.ArtifactPath)
+	}
+	return payload
+}
+
+func (d *Dispatcher) deliver(event job.Event, target string, body []byte) {
+	deliveryID := newDeliveryID()
+	for attempt := 1; attempt <= d.cfg.MaxAttempts; attempt++ {
+		record, refused := d.send(event, target, deliveryID, body)
+		record.Attempt = attempt
+		d.log.Record(event.JobID, record)
+		if record.Success || refused || attempt == d.cfg.MaxAttempts {
+			return
+		}
+		select {
+		case <-time.After(d.cfg.Backoff << (attempt - 1)):
+		case <-d.ctx.Done():
+			return
+		}
+	}
+}
+
+// send makes one delivery attempt; refused reports a private target, which
+// is not retried.
+func (d *Dispatcher) send(event job.Event, target, deliveryID string, body []byte) (record Delivery, refused bool) {
+	record = Delivery{ID: deliveryID, URL: target, Event: event.Type, Time: time.Now()}
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		record.Error = err.Error()
+		return record, false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, string(event.Type))
+	req.Header.Set(HeaderDelivery, deliveryID)
+	if d.cfg.Secret != "" {
+		req.Header.Set(HeaderSignature, Sign(d.cfg.Secret, body))
+	}
+	client := d.client
+	if !d.cfg.AllowPrivate && !d.configured(target) {
+		client = d.public
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		record.Error = err.Error()
+		return record, errors.Is(err, ErrPrivateTarget)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	record.StatusCode = resp.StatusCode
+	record.Success = resp.StatusCode >= 200 && resp.StatusCode < 300
+	if !record.Success {
+		record.Error = fmt.Sprintf("接收端返回 %s", resp.Status)
+	}
+	return record, false
+}
+
+func (d *Dispatcher) configured(target string) bool {
+	for _, url := range d.cfg.URLs {
+		if url == target {
+			return true
+		}
+	}
+	return false
+}
+
+// publicTransport dials public addresses only and bypasses any proxy, whose
+// address would be checked instead of the target's.
+func publicTransport() *http.Transport {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: refusePrivate}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return transport
+}
+
+func refusePrivate(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return ErrPrivateTarget
+	}
+	return nil
+}
+
+// Sign returns the signature header value for body: "sha256=" followed by the
+// hex HMAC-SHA256 of the raw request body keyed with secret.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func fileChecksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func newDeliveryID() string {
+	buf := make([]byte, 8)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
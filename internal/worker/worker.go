@@ -0,0 +1,333 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"nginx-automake/internal/job"
+)
+
+const (
+	// requestTimeout bounds every call to the coordinator except lease polls
+	// and artifact uploads.
+	requestTimeout = 30 * time.Second
+	uploadTimeout  = 10 * time.Minute
+	// reportInterval batches log lines; an idle job still reports every
+	// third of the lease TTL.
+	reportInterval = time.Second
+	retryDelay     = 5 * time.Second
+)
+
+type Config struct {
+	// Coordinator is the base URL of the server that hands out jobs, e.g.
+	// http://builder.example.com:8080.
+	Coordinator string
+	Token       string
+	Name        string
+	// Slots is how many leased jobs run at the same time.
+	Slots int
+	// PollWait bounds each lease request; the coordinator answers as soon
+	// as a job is queued.
+	PollWait time.Duration
+}
+
+// Worker pulls jobs from a coordinator, builds them with a local queue and
+// streams steps, logs and the artifact back.
+type Worker struct {
+	cfg    Config
+	queue  *job.Queue
+	client *http.Client
+
+	mu sync.Mutex
+	id string
+}
+
+func New(cfg Config, queue *job.Queue) *Worker {
+	if cfg.Slots <= 0 {
+		cfg.Slots = 1
+	}
+	if cfg.PollWait <= 0 {
+		cfg.PollWait = 30 * time.Second
+	}
+	if cfg.Name == "" {
+		cfg.Name, _ = os.Hostname()
+	}
+	cfg.Coordinator = strings.TrimRight(cfg.Coordinator, "/")
+	return &Worker{cfg: cfg, queue: queue, client: &http.Client{}}
+}
+
+// Run leases and builds jobs until ctx is cancelled. Jobs still running then
+// are stopped and handed back to the coordinator.
+func (w *Worker) Run(ctx context.Context) error {
+	if w.cfg.Coordinator == "" {
+		return errors.New("未配置 COORDINATOR_URL")
+	}
+	for {
+		err := w.register(ctx, "")
+		if err == nil {
+			break
+		}
+		log.Printf("注册构建节点失败: %v", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retryDelay):
+		}
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < w.cfg.Slots; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.loop(ctx)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// register obtains a worker ID unless another slot already replaced stale.
+func (w *Worker) register(ctx context.Context, stale string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.id != stale {
+		return nil
+	}
+	var registered job.RemoteWorker
+	body, _ := json.Marshal(map[string]string{"name": w.cfg.Name})
+	if err := w.call(ctx, requestTimeout, http.MethodPost, "/api/workers", bytes.NewReader(body), &registered); err != nil {
+		return err
+	}
+	w.id = registered.ID
+	log.Printf("已注册到 %s，节点 ID %s", w.cfg.Coordinator, w.id)
+	return nil
+}
+
+func (w *Worker) workerID() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.id
+}
+
+func (w *Worker) loop(ctx context.Context) {
+	for ctx.Err() == nil {
+		lease, err := w.lease(ctx)
+		switch {
+		case errors.Is(err, job.ErrWorkerUnknown):
+			err = w.register(ctx, w.workerID())
+		case err == nil && lease != nil:
+			w.run(ctx, *lease)
+			continue
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Printf("领取任务失败: %v", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(retryDelay):
+			}
+		}
+	}
+}
+
+func (w *Worker) lease(ctx context.Context) (*job.Lease, error) {
+	var lease job.Lease
+	path := fmt.Sprintf("/api/workers/%s/lease?wait=%s", w.workerID(), url.QueryEscape(w.cfg.PollWait.String()))
+	if err := w.call(ctx, w.cfg.PollWait+requestTimeout, http.MethodPost, path, nil, &lease); err != nil {
+		return nil, err
+	}
+	if lease.JobID == "" {
+		return nil, nil
+	}
+	return &lease, nil
+}
+
+// run builds one leased job. The build itself is not tied to ctx, so a
+// shutdown can still report and hand the job back after cancelling it.
+func (w *Worker) run(ctx context.Context, lease job.Lease) {
+	jobID := lease.JobID
+	log.Printf("开始编译任务 %s", jobID)
+	if _, err := w.queue.AcceptLease(lease); err != nil {
+		w.finish(jobID, job.WorkerResult{Error: err.Error()})
+		return
+	}
+	defer w.queue.ReleaseLease(jobID)
+	updates, stop, _ := w.queue.Watch(jobID)
+	defer stop()
+
+	buildCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- w.queue.RunLease(buildCtx, lease)
+	}()
+
+	heartbeat := time.Duration(lease.TTL) / 3
+	ticker := time.NewTicker(reportInterval)
+	defer ticker.Stop()
+	shutdown := ctx.Done()
+	var sent int64
+	var lastReport time.Time
+	var runErr error
+	dirty, abandoned, lost := true, false, false
+loop:
+	for {
+		select {
+		case runErr = <-done:
+			break loop
+		case <-updates:
+			dirty = true
+		case <-shutdown:
+			shutdown = nil
+			abandoned = true
+			cancel()
+		case <-ticker.C:
+			if lost || (!dirty && time.Since(lastReport) < heartbeat) {
+				continue
+			}
+			cancelled, err := w.report(jobID, &sent)
+			if err != nil {
+				if errors.Is(err, job.ErrLeaseLost) {
+					log.Printf("任务 %s 的租约已失效，停止编译", jobID)
+					lost = true
+					cancel()
+				} else {
+					log.Printf("上报任务 %s 进度失败: %v", jobID, err)
+				}
+				continue
+			}
+			dirty, lastReport = false, time.Now()
+			if cancelled {
+				cancel()
+			}
+		}
+	}
+	if lost {
+		return
+	}
+	if _, err := w.report(jobID, &sent); err != nil {
+		log.Printf("上报任务 %s 进度失败: %v", jobID, err)
+	}
+	if abandoned {
+		w.finish(jobID, job.WorkerResult{Abandoned: true})
+		return
+	}
+
+	result := job.WorkerResult{}
+	if built, ok := w.queue.Get(jobID); ok {
+		result.Result = built.Result
+		result.Script = built.Script
+		if runErr == nil {
+			if err := w.upload(jobID, built.ArtifactPath); err != nil {
+				runErr = fmt.Errorf("上传编译产物失败: %w", err)
+			}
+		}
+	}
+	if runErr != nil {
+		result.Error = runErr.Error()
+		result.TimedOut = errors.Is(runErr, job.ErrTimeout)
+	}
+	w.finish(jobID, result)
+	log.Printf("任务 %s 已结束", jobID)
+}
+
+// report sends the steps and the log lines after *sent, advancing *sent once
+// the coordinator has accepted them.
+func (w *Worker) report(jobID string, sent *int64) (bool, error) {
+	snapshot, ok := w.queue.Snapshot(jobID, *sent)
+	if !ok {
+		return false, job.ErrJobNotFound
+	}
+	body, err := json.Marshal(job.WorkerReport{Steps: snapshot.Steps, Logs: snapshot.Logs})
+	if err != nil {
+		return false, err
+	}
+	var response struct {
+		Cancel bool `json:"cancel"`
+	}
+	if err := w.call(context.Background(), requestTimeout, http.MethodPost, w.jobPath(jobID, "report"), bytes.NewReader(body), &response); err != nil {
+		return false, err
+	}
+	if n := len(snapshot.Logs); n > 0 {
+		*sent = snapshot.Logs[n-1].Seq
+	}
+	return response.Cancel, nil
+}
+
+func (w *Worker) upload(jobID, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	target := w.jobPath(jobID, "artifact") + "?name=" + url.QueryEscape(filepath.Base(path))
+	return w.call(context.Background(), uploadTimeout, http.MethodPut, target, file, nil)
+}
+
+func (w *Worker) finish(jobID string, result job.WorkerResult) {
+	body, err := json.Marshal(result)
+	if err != nil {
+		return
+	}
+	if err := w.call(context.Background(), requestTimeout, http.MethodPost, w.jobPath(jobID, "finish"), bytes.NewReader(body), nil); err != nil {
+		log.Printf("上报任务 %s 结果失败: %v", jobID, err)
+	}
+}
+
+func (w *Worker) jobPath(jobID, action string) string {
+	return fmt.Sprintf("/api/workers/%s/jobs/%s/%s", w.workerID(), jobID, action)
+}
+
+// call sends one request to the coordinator and decodes a JSON response into
+// out. 404 and 409 map to job.ErrWorkerUnknown and job.ErrLeaseLost.
+func (w *Worker) call(ctx context.Context, timeout time.Duration, method, path string, body io.Reader, out any) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, w.cfg.Coordinator+path, body)
+	if err != nil {
+		return err
+	}
+	if w.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+w.cfg.Token)
+	}
+	if method == http.MethodPut {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	} else {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return job.ErrWorkerUnknown
+	case resp.StatusCode == http.StatusConflict:
+		return job.ErrLeaseLost
+	case resp.StatusCode >= 300:
+		var failure struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&failure)
+		if failure.Error == "" {
+			failure.Error = resp.Status
+		}
+		return fmt.Errorf("协调节点返回错误: %s", failure.Error)
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -1,52 +1,116 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
 	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"nginx-automake/internal/cgroup"
 	"nginx-automake/internal/job"
+	"nginx-automake/internal/mail"
 	"nginx-automake/internal/modules"
 	"nginx-automake/internal/parser"
+	"nginx-automake/internal/sandbox"
+	"nginx-automake/internal/webhook"
+	"nginx-automake/internal/worker"
 )
 
 //go:embed web/* config/modules.json
 var assets embed.FS
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == sandbox.Command {
+		sandbox.Main(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "worker" {
+		runWorker()
+		return
+	}
+
 	gin.SetMode(gin.ReleaseMode)
 	if mode := os.Getenv("GIN_MODE"); mode != "" {
 		gin.SetMode(mode)
 	}
 
-	modulesData, err := assets.ReadFile("config/modules.json")
+	registry, cfg := buildConfig()
+	workers := getEnvInt("MAX_WORKERS", 2)
+	capacity := getEnvInt("QUEUE_CAPACITY", 100)
+	retention := getEnvDuration("JOB_RETENTION", 24*time.Hour)
+	retentionCount := getEnvInt("JOB_RETENTION_COUNT", 200)
+	historyPath := getEnv("HISTORY_FILE", "./data/history.json")
+	jobsPath := getEnv("JOBS_FILE", filepath.Join(filepath.Dir(historyPath), "jobs.json"))
+	groupsPath := getEnv("GROUPS_FILE", filepath.Join(filepath.Dir(historyPath), "groups.json"))
+	requeueInterrupted := getEnvBool("REQUEUE_INTERRUPTED", false)
+	shutdownGrace := getEnvDuration("SHUTDOWN_GRACE", 5*time.Minute)
+	adminToken := getEnv("ADMIN_TOKEN", "")
+	publicURL := getEnv("PUBLIC_URL", "")
+	webhookLogPath := getEnv("WEBHOOK_LOG_FILE", filepath.Join(filepath.Dir(historyPath), "webhooks.json"))
+	workerToken := getEnv("WORKER_TOKEN", "")
+
+	historyStore, err := job.NewHistoryStore(historyPath)
 	if err != nil {
 		panic(err)
 	}
-	registry, err := modules.LoadRegistry(modulesData)
+
+	cfg.Workers = workers
+	cfg.Capacity = capacity
+	cfg.Groups = job.NewGroupStore(groupsPath)
+	cfg.LeaseTTL = getEnvDuration("LEASE_TTL", time.Minute)
+	cfg.MaxTimeout = getEnvDuration("MAX_BUILD_TIMEOUT", cfg.Timeout)
+	cfg.Retention = retention
+	cfg.RetentionCount = retentionCount
+	queue := job.NewQueue(cfg, registry, historyStore, job.NewJobStore(jobsPath))
+	metrics := job.NewMetrics(queue.Events())
+	deliveryLog, err := webhook.NewDeliveryLog(webhookLogPath)
 	if err != nil {
 		panic(err)
 	}
+	webhooks := webhook.New(webhook.Config{
+		URLs:        splitList(getEnv("WEBHOOK_URLS", "")),
+		Secret:      getEnv("WEBHOOK_SECRET", ""),
+		BaseURL:     publicURL,
+		MaxAttempts: getEnvInt("WEBHOOK_MAX_ATTEMPTS", 5),
+		Backoff:     getEnvDuration("WEBHOOK_BACKOFF", 10*time.Second),
 
-	workers := getEnvInt("MAX_WORKERS", 2)
-	modulesDir := getEnv("MODULES_DIR", "./modules")
-	workRoot := getEnv("WORKDIR", "/tmp/nginx-build")
-	timeout := getEnvDuration("BUILD_TIMEOUT", 90*time.Minute)
-	historyPath := getEnv("HISTORY_FILE", "./data/history.json")
-
-	historyStore, err := job.NewHistoryStore(historyPath)
-	if err != nil {
+		AllowPrivate: getEnvBool("WEBHOOK_ALLOW_PRIVATE", false),
+	}, deliveryLog)
+	webhooks.Subscribe(queue.Events())
+	mailer := mail.New(mail.Config{
+		Host:     getEnv("SMTP_HOST", ""),
+		Port:     getEnvInt("SMTP_PORT", 25),
+		Username: getEnv("SMTP_USERNAME", ""),
+		Password: getEnv("SMTP_PASSWORD", ""),
+		From:     getEnv("SMTP_FROM", ""),
+		BaseURL:  publicURL,
+	})
+	mailer.Subscribe(queue.Events())
+	if err := queue.Restore(requeueInterrupted); err != nil {
 		panic(err)
 	}
-
-	queue := job.NewQueue(workers, modulesDir, workRoot, registry, timeout, historyStore)
 	queue.Start()
 
 	r := gin.Default()
+	if err := r.SetTrustedProxies(splitList(getEnv("TRUSTED_PROXIES", ""))); err != nil {
+		panic(err)
+	}
+	requesterID := requesterIdentity(splitList(getEnv("API_TOKENS", "")))
 	indexData, err := assets.ReadFile("web/index.html")
 	if err != nil {
 		panic(err)
@@ -76,6 +140,20 @@ func main() {
 		c.JSON(http.StatusOK, result)
 	})
 
+	r.POST("/api/plan", func(c *gin.Context) {
+		var payload job.BuildRequest
+		if err := c.ShouldBindJSON(&payload); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "请求数据格式错误"})
+			return
+		}
+		plan, err := queue.Plan(payload)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, plan)
+	})
+
 	r.POST("/api/build", func(c *gin.Context) {
 		var payload job.BuildRequest
 		if err := c.ShouldBindJSON(&payload); err != nil {
@@ -86,12 +164,65 @@ func main() {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		jobItem, err := queue.Enqueue(payload)
+		if payload.NotifyEmail != "" && !mailer.Enabled() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "服务器未配置邮件通知"})
+			return
+		}
+		if len(payload.TargetVersions) > 0 {
+			group, err := queue.SubmitMatrix(payload, requesterID(c))
+			if err != nil {
+				respondEnqueueError(c, queue, err)
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"groupId": group.ID, "jobs": group.Members})
+			return
+		}
+		submission, err := queue.Submit(payload, requesterID(c))
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			respondEnqueueError(c, queue, err)
 			return
 		}
-		c.JSON(http.StatusOK, gin.H{"id": jobItem.ID})
+		c.JSON(http.StatusOK, gin.H{"id": submission.Job.ID, "reused": submission.Reused, "handle": submission.Handle})
+	})
+
+	r.GET("/api/groups/:id", func(c *gin.Context) {
+		group, ok := queue.Group(c.Param("id"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "编译组不存在"})
+			return
+		}
+		c.JSON(http.StatusOK, group)
+	})
+
+	r.GET("/api/jobs", func(c *gin.Context) {
+		filter := job.ListFilter{
+			Version: strings.TrimSpace(c.Query("version")),
+			Module:  strings.TrimSpace(c.Query("module")),
+		}
+		for _, status := range strings.Split(c.Query("status"), ",") {
+			if status = strings.TrimSpace(status); status != "" {
+				filter.Statuses = append(filter.Statuses, job.Status(status))
+			}
+		}
+		var err error
+		if value := c.Query("since"); value != "" {
+			if filter.Since, err = time.Parse(time.RFC3339, value); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "since 时间格式错误，应为 RFC3339"})
+				return
+			}
+		}
+		if value := c.Query("until"); value != "" {
+			if filter.Until, err = time.Parse(time.RFC3339, value); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "until 时间格式错误，应为 RFC3339"})
+				return
+			}
+		}
+		filter.Page, _ = strconv.Atoi(c.DefaultQuery("page", "1"))
+		filter.PageSize, _ = strconv.Atoi(c.DefaultQuery("pageSize", "20"))
+		if filter.PageSize > 200 {
+			filter.PageSize = 200
+		}
+		c.JSON(http.StatusOK, queue.List(filter))
 	})
 
 	r.GET("/api/jobs/:id", func(c *gin.Context) {
@@ -101,7 +232,86 @@ func main() {
 			c.JSON(http.StatusNotFound, gin.H{"error": "任务不存在"})
 			return
 		}
-		c.JSON(http.StatusOK, jobItem)
+		c.JSON(http.StatusOK, jobItem.Public())
+	})
+
+	r.GET("/api/jobs/:id/events", streamJobEvents(queue))
+
+	r.GET("/api/jobs/:id/logs", func(c *gin.Context) {
+		afterSeq, _ := strconv.ParseInt(c.Query("after"), 10, 64)
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "500"))
+		if err != nil || limit <= 0 {
+			limit = 500
+		}
+		if limit > 5000 {
+			limit = 5000
+		}
+		filter := job.LogFilter{Stream: job.LogStream(c.Query("stream")), Step: c.Query("step")}
+		switch filter.Stream {
+		case "", job.StreamStdout, job.StreamStderr, job.StreamSystem:
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "无效的日志流"})
+			return
+		}
+		page, ok := queue.Logs(c.Param("id"), afterSeq, limit, filter)
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "任务不存在"})
+			return
+		}
+		c.JSON(http.StatusOK, page)
+	})
+
+	r.GET("/api/jobs/:id/webhooks", func(c *gin.Context) {
+		deliveries := deliveryLog.Get(c.Param("id"))
+		for i := range deliveries {
+			deliveries[i] = deliveries[i].Redacted()
+		}
+		c.JSON(http.StatusOK, gin.H{"deliveries": deliveries})
+	})
+
+	r.POST("/api/jobs/:id/cancel", func(c *gin.Context) {
+		var payload struct {
+			Handle string `json:"handle"`
+		}
+		if err := bindOptionalJSON(c, &payload); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "请求数据格式错误"})
+			return
+		}
+		detached, err := queue.Cancel(c.Param("id"), payload.Handle)
+		switch {
+		case errors.Is(err, job.ErrJobNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, job.ErrJobFinished), errors.Is(err, job.ErrJobShared):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusOK, gin.H{"status": "ok", "detached": detached})
+		}
+	})
+
+	r.POST("/api/jobs/:id/retry", func(c *gin.Context) {
+		var opts job.RebuildOptions
+		if err := bindOptionalJSON(c, &opts); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "请求数据格式错误"})
+			return
+		}
+		submission, err := queue.Retry(c.Param("id"), opts, requesterID(c))
+		if err != nil {
+			respondEnqueueError(c, queue, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"id": submission.Job.ID, "handle": submission.Handle})
+	})
+
+	r.GET("/api/jobs/:id/log", func(c *gin.Context) {
+		jobID := c.Param("id")
+		jobItem, ok := queue.Get(jobID)
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "任务不存在"})
+			return
+		}
+		serveLogFile(c, jobItem.ID, jobItem.LogPath)
 	})
 
 	r.GET("/api/jobs/:id/download", func(c *gin.Context) {
@@ -123,41 +333,443 @@ func main() {
 	})
 
 	r.GET("/api/history", func(c *gin.Context) {
-		c.JSON(http.StatusOK, historyStore.List())
+		entries := historyStore.List()
+		for i := range entries {
+			entries[i] = entries[i].Public()
+		}
+		c.JSON(http.StatusOK, entries)
 	})
 
 	r.GET("/api/history/:id/download", func(c *gin.Context) {
-		historyID := c.Param("id")
-		entries := historyStore.List()
-		for _, entry := range entries {
-			if entry.ID == historyID {
-				if entry.Artifact == "" {
-					c.JSON(http.StatusBadRequest, gin.H{"error": "产物不存在"})
-					return
-				}
-				filename := "nginx"
-				if entry.Version != "" {
-					filename = "nginx-" + entry.Version
-				}
-				c.FileAttachment(entry.Artifact, filename)
-				return
-			}
+		entry, ok := historyStore.Get(c.Param("id"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "记录不存在"})
+			return
 		}
-		c.JSON(http.StatusNotFound, gin.H{"error": "记录不存在"})
+		if entry.Artifact == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "产物不存在"})
+			return
+		}
+		filename := "nginx"
+		if entry.Version != "" {
+			filename = "nginx-" + entry.Version
+		}
+		c.FileAttachment(entry.Artifact, filename)
+	})
+
+	r.GET("/api/history/:id/log", func(c *gin.Context) {
+		entry, ok := historyStore.Get(c.Param("id"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "记录不存在"})
+			return
+		}
+		serveLogFile(c, entry.ID, entry.LogFile)
+	})
+
+	r.POST("/api/history/:id/rebuild", func(c *gin.Context) {
+		entry, ok := historyStore.Get(c.Param("id"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "记录不存在"})
+			return
+		}
+		var opts job.RebuildOptions
+		if err := bindOptionalJSON(c, &opts); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "请求数据格式错误"})
+			return
+		}
+		submission, err := queue.Rebuild(entry, opts, requesterID(c))
+		if err != nil {
+			respondEnqueueError(c, queue, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"id": submission.Job.ID, "handle": submission.Handle})
+	})
+
+	r.GET("/api/stats/durations", func(c *gin.Context) {
+		c.JSON(http.StatusOK, historyStore.Stats())
+	})
+
+	r.GET("/api/metrics", func(c *gin.Context) {
+		c.JSON(http.StatusOK, metrics.Snapshot())
 	})
 
 	r.GET("/api/health", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+		c.JSON(http.StatusOK, gin.H{"status": "ok", "draining": queue.Draining()})
 	})
 
+	if workerToken != "" {
+		remote := r.Group("/api/workers", bearerAuth(workerToken, "构建节点令牌无效"))
+
+		remote.POST("", func(c *gin.Context) {
+			var payload struct {
+				Name string `json:"name"`
+			}
+			if err := bindOptionalJSON(c, &payload); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "请求数据格式错误"})
+				return
+			}
+			worker, err := queue.RegisterWorker(strings.TrimSpace(payload.Name))
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, worker)
+		})
+
+		remote.POST("/:id/lease", func(c *gin.Context) {
+			wait, err := time.ParseDuration(c.DefaultQuery("wait", "30s"))
+			if err != nil || wait < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "wait 参数格式错误"})
+				return
+			}
+			lease, err := queue.Lease(c.Request.Context(), c.Param("id"), wait)
+			if err != nil {
+				respondLeaseError(c, err)
+				return
+			}
+			if lease == nil {
+				c.Status(http.StatusNoContent)
+				return
+			}
+			c.JSON(http.StatusOK, lease)
+		})
+
+		remote.POST("/:id/jobs/:job/report", func(c *gin.Context) {
+			var payload job.WorkerReport
+			if err := c.ShouldBindJSON(&payload); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "请求数据格式错误"})
+				return
+			}
+			cancel, err := queue.Report(c.Param("id"), c.Param("job"), payload)
+			if err != nil {
+				respondLeaseError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"cancel": cancel})
+		})
+
+		remote.PUT("/:id/jobs/:job/artifact", func(c *gin.Context) {
+			if err := queue.StoreArtifact(c.Param("id"), c.Param("job"), c.Query("name"), c.Request.Body); err != nil {
+				respondLeaseError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"status": "ok"})
+		})
+
+		remote.POST("/:id/jobs/:job/finish", func(c *gin.Context) {
+			var payload job.WorkerResult
+			if err := c.ShouldBindJSON(&payload); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "请求数据格式错误"})
+				return
+			}
+			if err := queue.FinishLease(c.Param("id"), c.Param("job"), payload); err != nil {
+				respondLeaseError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"status": "ok"})
+		})
+	}
+
+	if adminToken != "" {
+		admin := r.Group("/api/admin", bearerAuth(adminToken, "管理令牌无效"))
+
+		admin.POST("/drain", func(c *gin.Context) {
+			var payload struct {
+				Enabled *bool `json:"enabled"`
+			}
+			if err := bindOptionalJSON(c, &payload); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "请求数据格式错误"})
+				return
+			}
+			enabled := payload.Enabled == nil || *payload.Enabled
+			queue.SetDraining(enabled)
+			c.JSON(http.StatusOK, gin.H{"draining": enabled})
+		})
+
+		admin.GET("/status", func(c *gin.Context) {
+			c.JSON(http.StatusOK, queue.PoolStatus())
+		})
+
+		admin.POST("/workers", func(c *gin.Context) {
+			var payload struct {
+				Count *int `json:"count"`
+			}
+			if err := c.ShouldBindJSON(&payload); err != nil || payload.Count == nil || *payload.Count < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "请提供有效的 worker 数量"})
+				return
+			}
+			queue.Resize(*payload.Count)
+			c.JSON(http.StatusOK, queue.PoolStatus())
+		})
+
+		admin.POST("/pause", func(c *gin.Context) {
+			queue.SetPaused(true)
+			c.JSON(http.StatusOK, queue.PoolStatus())
+		})
+
+		admin.POST("/resume", func(c *gin.Context) {
+			queue.SetPaused(false)
+			c.JSON(http.StatusOK, queue.PoolStatus())
+		})
+	}
+
 	port := getEnv("PORT", "8080")
-	if strings.HasPrefix(port, ":") {
-		r.Run(port)
+	if !strings.HasPrefix(port, ":") {
+		port = ":" + port
+	}
+	server := &http.Server{Addr: port, Handler: r}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			panic(err)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+
+	log.Printf("收到退出信号，等待运行中的任务完成（最长 %s）", shutdownGrace)
+	graceCtx, cancelGrace := context.WithTimeout(context.Background(), shutdownGrace)
+	queue.Shutdown(graceCtx)
+	cancelGrace()
+	webhooks.Close()
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelShutdown()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		server.Close()
+	}
+}
+
+// bearerAuth requires "Authorization: Bearer <token>".
+func bearerAuth(token, message string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		provided := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": message})
+			return
+		}
+		c.Next()
+	}
+}
+
+func serveLogFile(c *gin.Context, id, path string) {
+	if path == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "日志文件不存在"})
+		return
+	}
+	if _, err := os.Stat(path); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "日志文件不存在"})
+		return
+	}
+	c.FileAttachment(path, "nginx-build-"+id+".log.gz")
+}
+
+func respondEnqueueError(c *gin.Context, queue *job.Queue, err error) {
+	switch {
+	case errors.Is(err, job.ErrDraining):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	case errors.Is(err, job.ErrQueueFull):
+		c.Header("Retry-After", strconv.Itoa(int(queue.RetryAfter().Seconds())))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+	case errors.Is(err, job.ErrJobNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, job.ErrJobNotFinished):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+func respondLeaseError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, job.ErrWorkerUnknown):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, job.ErrLeaseLost):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+func bindOptionalJSON(c *gin.Context, target any) error {
+	if c.Request.ContentLength == 0 {
+		return nil
+	}
+	return c.ShouldBindJSON(target)
+}
+
+// requesterIdentity returns the function naming who submitted a request for
+// fair scheduling. Only tokens listed in API_TOKENS count; anyone else is
+// known by the client IP, which honours forwarding headers only from
+// TRUSTED_PROXIES.
+func requesterIdentity(tokens []string) func(*gin.Context) string {
+	known := make(map[string]bool, len(tokens))
+	for _, token := range tokens {
+		known[token] = true
+	}
+	return func(c *gin.Context) string {
+		token := strings.TrimSpace(c.GetHeader("X-API-Token"))
+		if token == "" {
+			token = strings.TrimSpace(strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer "))
+		}
+		if known[token] {
+			sum := sha256.Sum256([]byte(token))
+			return "token:" + hex.EncodeToString(sum[:6])
+		}
+		return "ip:" + c.ClientIP()
+	}
+}
+
+func streamJobEvents(queue *job.Queue) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		jobID := c.Param("id")
+		lastID := c.GetHeader("Last-Event-ID")
+		if lastID == "" {
+			lastID = c.Query("lastEventId")
+		}
+		afterSeq, _ := strconv.ParseInt(lastID, 10, 64)
+
+		updates, stop, ok := queue.Watch(jobID)
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "任务不存在"})
+			return
+		}
+		defer stop()
+
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Header("X-Accel-Buffering", "no")
+		c.Status(http.StatusOK)
+
+		keepAlive := time.NewTicker(15 * time.Second)
+		defer keepAlive.Stop()
+
+		var lastStatus job.Status
+		var lastSteps string
+		for {
+			snapshot, ok := queue.Snapshot(jobID, afterSeq)
+			if !ok {
+				return
+			}
+			if snapshot.Status != lastStatus {
+				writeSSE(c.Writer, "", "status", gin.H{"status": snapshot.Status, "error": snapshot.Error})
+				lastStatus = snapshot.Status
+			}
+			if steps, _ := json.Marshal(snapshot.Steps); string(steps) != lastSteps {
+				writeSSE(c.Writer, "", "steps", snapshot.Steps)
+				lastSteps = string(steps)
+			}
+			for _, line := range snapshot.Logs {
+				writeSSE(c.Writer, strconv.FormatInt(line.Seq, 10), "log", line)
+				afterSeq = line.Seq
+			}
+			c.Writer.Flush()
+			if snapshot.Status.Finished() {
+				writeSSE(c.Writer, "", "done", gin.H{"status": snapshot.Status})
+				c.Writer.Flush()
+				return
+			}
+
+			select {
+			case <-updates:
+			case <-keepAlive.C:
+				io.WriteString(c.Writer, ": keep-alive\n\n")
+				c.Writer.Flush()
+			case <-c.Request.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+func writeSSE(w io.Writer, id, event string, payload any) {
+	data, err := json.Marshal(payload)
+	if err != nil {
 		return
 	}
-	if err := r.Run(":" + port); err != nil {
+	if id != "" {
+		fmt.Fprintf(w, "id: %s\n", id)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+}
+
+// buildConfig reads the settings that decide how this process builds jobs;
+// the server and worker modes share them.
+func buildConfig() (*modules.Registry, job.Config) {
+	modulesData, err := assets.ReadFile("config/modules.json")
+	if err != nil {
+		panic(err)
+	}
+	registry, err := modules.LoadRegistry(modulesData)
+	if err != nil {
 		panic(err)
 	}
+	buildCPUs := getEnvFloat("BUILD_CPUS", 0)
+	buildMemory, err := cgroup.ParseSize(getEnv("BUILD_MEMORY", ""))
+	if err != nil {
+		panic(err)
+	}
+	var cgroups *cgroup.Manager
+	if cgroupRoot := getEnv("CGROUP_ROOT", ""); cgroupRoot != "" {
+		cgroups, err = cgroup.NewManager(cgroupRoot, buildCPUs, buildMemory)
+		if err != nil {
+			panic(err)
+		}
+	}
+	return registry, job.Config{
+		ModulesDir: getEnv("MODULES_DIR", "./modules"),
+		WorkRoot:   getEnv("WORKDIR", "/tmp/nginx-build"),
+		Timeout:    getEnvDuration("BUILD_TIMEOUT", 90*time.Minute),
+		StepTimeouts: job.StepTimeouts{
+			Download:  getEnvDuration("DOWNLOAD_TIMEOUT", 10*time.Minute),
+			Clone:     getEnvDuration("CLONE_TIMEOUT", 10*time.Minute),
+			Configure: getEnvDuration("CONFIGURE_TIMEOUT", 10*time.Minute),
+			Make:      getEnvDuration("MAKE_TIMEOUT", 0),
+		},
+		CPUs:     buildCPUs,
+		Cgroups:  cgroups,
+		Sandbox:  getEnvBool("SANDBOX", false),
+		HooksDir: getEnv("HOOKS_DIR", ""),
+
+		RequestWebhooks: getEnvBool("REQUEST_WEBHOOKS", true),
+	}
+}
+
+// runWorker is the "worker" subcommand: instead of serving HTTP it leases
+// jobs from COORDINATOR_URL and builds them with this host's settings.
+func runWorker() {
+	registry, cfg := buildConfig()
+	slots := getEnvInt("WORKER_SLOTS", 1)
+	cfg.Workers = slots
+	// A worker must not share its work root with a coordinator on the same
+	// host: releasing a job removes its directory there.
+	cfg.WorkRoot = getEnv("WORKDIR", "/tmp/nginx-build-worker")
+	queue := job.NewQueue(cfg, registry, nil, nil)
+	w := worker.New(worker.Config{
+		Coordinator: getEnv("COORDINATOR_URL", ""),
+		Token:       getEnv("WORKER_TOKEN", ""),
+		Name:        getEnv("WORKER_NAME", ""),
+		Slots:       slots,
+		PollWait:    getEnvDuration("WORKER_POLL_WAIT", 30*time.Second),
+	}, queue)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if err := w.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+		log.Fatal(err)
+	}
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
 
 func getEnv(key, def string) string {
@@ -179,6 +791,28 @@ func getEnvInt(key string, def int) int {
 	return def
 }
 
+func getEnvFloat(key string, def float64) float64 {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return def
+	}
+	if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+		return parsed
+	}
+	return def
+}
+
+func getEnvBool(key string, def bool) bool {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return def
+	}
+	if parsed, err := strconv.ParseBool(value); err == nil {
+		return parsed
+	}
+	return def
+}
+
 func getEnvDuration(key string, def time.Duration) time.Duration {
 	value := strings.TrimSpace(os.Getenv(key))
 	if value == "" {